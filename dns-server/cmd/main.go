@@ -5,12 +5,13 @@ import (
 	"flag"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/mikhailv/keenetic-dns/agent"
 	. "github.com/mikhailv/keenetic-dns/dns-server/internal" //nolint:stylecheck //ignore
+	"github.com/mikhailv/keenetic-dns/dns-server/internal/metrics"
 	"github.com/mikhailv/keenetic-dns/internal/log"
 	"github.com/mikhailv/keenetic-dns/internal/setup"
 	"github.com/mikhailv/keenetic-dns/internal/stream"
@@ -36,7 +37,7 @@ func main() {
 	setup.Pprof(ctx, *pprofAddr, logger)
 
 	dnsStore := NewDNSStore()
-	saveStore := initDNSStore(cfg.Dump.File, log.WithPrefix(logger, "dns_store"), dnsStore)
+	saveStore := initDump(cfg.Dump.File, log.WithPrefix(logger, "dns_store"), dnsStore)
 	go util.RunPeriodically(ctx, cfg.Dump.Interval, func(ctx context.Context) { saveStore() })
 
 	networkService := agent.NewNetworkServiceClient(cfg.AgentBaseURL, cfg.AgentTimeout)
@@ -44,39 +45,81 @@ func main() {
 	ipRoutes := NewIPRouteController(cfg.Routing, log.WithPrefix(logger, "routes"), dnsStore, networkService, cfg.ReconcileInterval, cfg.ReconcileTimeout)
 	ipRoutes.Start(ctx)
 
-	listenConfigUpdate(logger, *configFile, 5*time.Second, func(cfg Config) {
+	listenConfigUpdate(logger, *configFile, cfg, 5*time.Second, func(cfg Config) {
 		ipRoutes.UpdateConfig(ctx, cfg.Routing.RoutingDynamicConfig)
 	})
 
-	var dnsProvider DNSResolver
-	if strings.HasPrefix(cfg.DNSProvider, "http") {
-		dnsProvider = NewDoHClient(cfg.DNSProvider, cfg.DNSProviderTimeout)
-	} else {
-		dnsProvider = NewDNSClient(cfg.DNSProvider, cfg.DNSProviderTimeout)
-	}
+	upstreams, dnsProvider := initUpstreams(logger, cfg)
 	dnsProvider = NewMDNSResolver(dnsProvider, cfg.MDNS)
 
-	dnsCache := NewDNSCache()
+	dnsCache := NewDNSCache(cfg.DNSCache)
 	go util.RunPeriodically(ctx, time.Minute, func(ctx context.Context) { dnsCache.RemoveExpired() })
+	saveCache := func() {}
+	if cfg.DNSCache.Dump.File != "" {
+		saveCache = initDump(cfg.DNSCache.Dump.File, log.WithPrefix(logger, "dns_cache"), dnsCache)
+		go util.RunPeriodically(ctx, cfg.DNSCache.Dump.Interval, func(ctx context.Context) { saveCache() })
+	}
 
-	service := NewDNSRoutingService(log.WithPrefix(logger, "dns_svc"), dnsProvider, dnsStore, ipRoutes, cfg.DNSQueryHistorySize)
-
-	resolver := NewSingleInflightDNSResolver(service)
+	resolver := NewSingleInflightDNSResolver(dnsProvider)
 	resolver = NewCachedDNSResolver(resolver, dnsCache)
-	resolver = NewTTLOverridingDNSResolver(resolver, cfg.DNSTTLOverride)
 
-	httpServer := NewHTTPServer(cfg.HTTPAddr, log.WithPrefix(logger, "http"), resolver, ipRoutes, logStream, service.QueryStream(), service.RawQueryStream())
+	// routing service is above the cache, so cached responses still refresh routes and appear in query stream
+	service := NewDNSRoutingService(log.WithPrefix(logger, "dns_svc"), resolver, dnsStore, ipRoutes, cfg.DNSQueryHistorySize)
+
+	resolver = NewTTLOverridingDNSResolver(service, cfg.DNSTTLOverride)
+
+	metrics.RegisterStreamDroppedNotifications("logs", logStream.Dropped)
+	metrics.RegisterStreamDroppedNotifications("dns_queries", service.QueryStream().Dropped)
+	metrics.RegisterStreamDroppedNotifications("dns_raw_queries", service.RawQueryStream().Dropped)
+
+	closeLogHistory := initHistory(cfg.History, "logs", log.WithPrefix(logger, "history"), logStream)
+	closeQueryHistory := initHistory(cfg.History, "dns_queries", log.WithPrefix(logger, "history"), service.QueryStream())
+
+	httpServer := NewHTTPServer(cfg.HTTPAddr, log.WithPrefix(logger, "http"), resolver, ipRoutes, upstreams, dnsCache,
+		logStream, service.QueryStream(), service.RawQueryStream())
 	go httpServer.Serve(ctx)
 
-	udpServer := NewDNSServer(cfg.Addr, log.WithPrefix(logger, "dns"), resolver)
-	go udpServer.Serve(ctx)
+	dnsServer := NewDNSServer(cfg.Listeners, log.WithPrefix(logger, "dns"), resolver)
+	go dnsServer.Serve(ctx)
 
 	<-ctx.Done()
 
 	saveStore()
+	saveCache()
+	closeQueryHistory()
+	closeLogHistory()
+}
+
+func initUpstreams(logger *slog.Logger, cfg *Config) ([]*Upstream, DNSResolver) {
+	upstreams, err := NewUpstreams("dns_providers", cfg.DNSProviders, cfg.DNSProviderTimeout, cfg.DNSUpstream)
+	if err != nil {
+		logger.Error("failed to create upstreams", "err", err)
+		os.Exit(1)
+	}
+	resolver := NewUpstreamsDNSResolver(upstreams, cfg.DNSUpstream)
+
+	forwardingRules := make([]ForwardingRule, 0, len(cfg.DNSForward))
+	for i, fwd := range cfg.DNSForward {
+		fwdUpstreams, err := NewUpstreams(fmt.Sprintf("dns_forward[%d].providers", i), fwd.Providers, cfg.DNSProviderTimeout, cfg.DNSUpstream)
+		if err != nil {
+			logger.Error("failed to create forwarding upstreams", "err", err)
+			os.Exit(1)
+		}
+		upstreams = append(upstreams, fwdUpstreams...)
+		forwardingRules = append(forwardingRules, ForwardingRule{
+			Domains:  fwd.Domains,
+			Resolver: NewUpstreamsDNSResolver(fwdUpstreams, cfg.DNSUpstream),
+		})
+	}
+	return upstreams, NewForwardingDNSResolver(resolver, forwardingRules)
+}
+
+type dumper interface {
+	Load(file string) error
+	Save(file string) error
 }
 
-func initDNSStore(file string, logger *slog.Logger, store *DNSStore) (save func()) {
+func initDump(file string, logger *slog.Logger, store dumper) (save func()) {
 	logger = logger.With("file", file)
 	if err := store.Load(file); err != nil {
 		logger.Error("failed to load", "err", err)
@@ -89,6 +132,22 @@ func initDNSStore(file string, logger *slog.Logger, store *DNSStore) (save func(
 	}
 }
 
+func initHistory[T any](cfg HistoryConfig, name string, logger *slog.Logger, st *stream.Buffered[T]) (closeFn func()) {
+	if cfg.Dir == "" {
+		return func() {}
+	}
+	archive, err := stream.NewArchive[T](stream.ArchiveConfig(cfg), name, logger)
+	if err != nil {
+		logger.Error("failed to open history", "err", err, "name", name)
+		return func() {}
+	}
+	st.SetArchive(archive)
+	return func() {
+		st.SetArchive(nil)
+		archive.Close()
+	}
+}
+
 func setupLogger(debug bool, historySize int) (*slog.Logger, *stream.Buffered[log.Entry]) {
 	var recorder log.Recorder
 	logger := setup.Logger(debug, func(handler slog.Handler) slog.Handler {
@@ -98,35 +157,43 @@ func setupLogger(debug bool, historySize int) (*slog.Logger, *stream.Buffered[lo
 	return logger, recorder.Stream()
 }
 
-func listenConfigUpdate(logger *slog.Logger, configFile string, updateCheckInterval time.Duration, onUpdate func(cfg Config)) {
-	getModTime := func() (time.Time, bool) {
-		f, err := os.Stat(configFile)
-		if err != nil {
-			return time.Time{}, false
+// listenConfigUpdate reloads config when the config file or any host list or geo data file referenced by it changes.
+func listenConfigUpdate(logger *slog.Logger, configFile string, cfg *Config, updateCheckInterval time.Duration, onUpdate func(cfg Config)) {
+	getModTimes := func(cfg *Config) map[string]time.Time {
+		res := map[string]time.Time{}
+		for _, file := range append([]string{configFile}, cfg.Routing.ReferencedFiles()...) {
+			if f, err := os.Stat(file); err == nil {
+				res[file] = f.ModTime()
+			}
 		}
-		return f.ModTime(), true
+		return res
 	}
 
-	reloadConfig := func() bool {
+	reloadConfig := func() *Config {
 		if cfg, err := LoadConfig(configFile); err != nil {
 			logger.Error("failed to load config", "err", err)
-			return false
+			return nil
 		} else {
 			logger.Info("config change detected")
 			onUpdate(*cfg)
-			return true
+			return cfg
 		}
 	}
 
-	modTime, _ := getModTime()
+	modTimes := getModTimes(cfg)
 
 	go func() {
 		for range time.Tick(updateCheckInterval) {
-			if t, ok := getModTime(); ok && t.After(modTime) {
-				if reloadConfig() {
-					modTime = t
-				}
+			newModTimes := getModTimes(cfg)
+			if maps.Equal(newModTimes, modTimes) {
+				continue
+			}
+			if newCfg := reloadConfig(); newCfg != nil {
+				cfg = newCfg
+				newModTimes = getModTimes(cfg)
 			}
+			// remember mod times even if reload failed, so that it's retried only when files change again
+			modTimes = newModTimes
 		}
 	}()
 }
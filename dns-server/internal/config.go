@@ -2,8 +2,12 @@ package internal
 
 import (
 	_ "embed"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -14,31 +18,90 @@ import (
 var defaultConfigYAML []byte
 
 type Config struct {
-	Addr     string `yaml:"addr"`
-	HTTPAddr string `yaml:"http_addr"`
+	Addr      string             `yaml:"addr"`
+	HTTPAddr  string             `yaml:"http_addr"`
+	Listeners DNSListenersConfig `yaml:"listeners"`
 
-	LogHistorySize      int `yaml:"log_history_size"`
-	DNSQueryHistorySize int `yaml:"dns_query_history_size"`
+	LogHistorySize      int           `yaml:"log_history_size"`
+	DNSQueryHistorySize int           `yaml:"dns_query_history_size"`
+	History             HistoryConfig `yaml:"history"`
 
 	AgentBaseURL string        `yaml:"agent_base_url"`
 	AgentTimeout time.Duration `yaml:"agent_timeout"`
 
-	DNSProvider        string        `yaml:"dns_provider"`
-	DNSProviderTimeout time.Duration `yaml:"dns_provider_timeout"`
-	DNSTTLOverride     time.Duration `yaml:"dns_ttl_override"`
+	DNSProvider        string            `yaml:"dns_provider"`
+	DNSProviders       []string          `yaml:"dns_providers"`
+	DNSProviderTimeout time.Duration     `yaml:"dns_provider_timeout"`
+	DNSUpstream        DNSUpstreamConfig `yaml:"dns_upstream"`
+	DNSTTLOverride     time.Duration     `yaml:"dns_ttl_override"`
 
 	ReconcileInterval time.Duration `yaml:"reconcile_interval"`
 	ReconcileTimeout  time.Duration `yaml:"reconcile_timeout"`
 
+	DNSForward []DNSForwardConfig `yaml:"dns_forward"`
+	DNSCache   DNSCacheConfig     `yaml:"dns_cache"`
+
 	MDNS    MDNSConfig    `yaml:"mdns"`
 	Dump    DumpConfig    `yaml:"dump"`
 	Routing RoutingConfig `yaml:"routing"`
 }
 
+const (
+	UpstreamStrategyFailover = "failover"
+	UpstreamStrategyRace     = "race"
+)
+
+type DNSListenersConfig struct {
+	UDP DNSListenerConfig    `yaml:"udp"`
+	TCP DNSListenerConfig    `yaml:"tcp"`
+	TLS DNSTLSListenerConfig `yaml:"tls"`
+}
+
+type DNSListenerConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Addrs   []string `yaml:"addrs"`
+}
+
+type DNSTLSListenerConfig struct {
+	DNSListenerConfig `yaml:",inline"`
+	CertFile          string `yaml:"cert_file"`
+	KeyFile           string `yaml:"key_file"`
+}
+
+type DNSUpstreamConfig struct {
+	Strategy         string        `yaml:"strategy"`
+	HedgeDelay       time.Duration `yaml:"hedge_delay"`
+	AttemptTimeout   time.Duration `yaml:"attempt_timeout"`
+	FailureThreshold int           `yaml:"failure_threshold"`
+	Cooldown         time.Duration `yaml:"cooldown"`
+}
+
+type DNSForwardConfig struct {
+	Domains   DomainSuffixes `yaml:"domains"`
+	Providers []string       `yaml:"providers"`
+}
+
+type DNSCacheConfig struct {
+	MaxEntries         int           `yaml:"max_entries"`
+	NegativeMaxTTL     time.Duration `yaml:"negative_max_ttl"`
+	StaleTTL           time.Duration `yaml:"stale_ttl"`
+	StaleAnswerTTL     time.Duration `yaml:"stale_answer_ttl"`
+	StaleAnswerTimeout time.Duration `yaml:"stale_answer_timeout"`
+	PrefetchMinHits    int           `yaml:"prefetch_min_hits"`
+	Dump               DumpConfig    `yaml:"dump"`
+}
+
 type MDNSConfig struct {
-	Domains      []string      `yaml:"domains"`
-	Addr         string        `yaml:"addr"`
-	QueryTimeout time.Duration `yaml:"query_timeout"`
+	Domains      DomainSuffixes `yaml:"domains"`
+	Addr         string         `yaml:"addr"`
+	QueryTimeout time.Duration  `yaml:"query_timeout"`
+}
+
+type HistoryConfig struct {
+	Dir         string        `yaml:"dir"`
+	SegmentSize int64         `yaml:"segment_size"`
+	MaxSize     int64         `yaml:"max_size"`
+	MaxAge      time.Duration `yaml:"max_age"`
 }
 
 type DumpConfig struct {
@@ -52,9 +115,19 @@ type RoutingConfig struct {
 }
 
 type RoutingDynamicConfig struct {
-	RouteTimeout time.Duration     `yaml:"route_timeout"`
-	Hosts        map[string]Hosts  `yaml:"hosts"`
-	Static       map[string][]IPv4 `yaml:"static"`
+	RouteTimeout      time.Duration       `yaml:"route_timeout"`
+	Hosts             map[string]Hosts    `yaml:"hosts"`
+	HostFiles         map[string][]string `yaml:"host_files"`
+	InterfacePriority []string            `yaml:"interface_priority"`
+	Static            map[string][]string `yaml:"static"`
+	GeoSiteFile       string              `yaml:"geosite_file"`
+	GeoIPFile         string              `yaml:"geoip_file"`
+
+	fileHosts      map[string][]hostPattern // patterns loaded from host files and geosite categories
+	fileStatic     map[string][]IPv4        // networks loaded from geoip codes
+	geoSiteSkipped map[string]int           // number of geosite domains skipped by category
+	staticAddrs    map[string][]IPv4
+	hostsTrie      *domainTrie
 }
 
 type RoutingRuleConfig struct {
@@ -63,46 +136,243 @@ type RoutingRuleConfig struct {
 	Priority int    `yaml:"priority"`
 }
 
-type Hosts []string
+type DomainSuffixes []string
 
-func (s Hosts) LookupHost(host string) bool {
-	for _, h := range s {
-		if host == h || strings.HasSuffix(host, "."+h) {
-			return true
+func (s DomainSuffixes) normalize() error {
+	for i := range s {
+		domain, err := normalizeDomain(strings.Trim(s[i], "."))
+		if err != nil {
+			return fmt.Errorf("domains[%d]: %w", i, err)
 		}
+		s[i] = "." + domain + "."
 	}
-	return false
+	return nil
 }
 
-func (c *RoutingConfig) LookupHost(host string) (iface string) {
-	for iface, hosts := range c.Hosts {
-		if hosts.LookupHost(host) {
-			return iface
+// Match returns the longest suffix matching the FQDN (with trailing dot) name, or empty string if none matches.
+func (s DomainSuffixes) Match(name string) string {
+	name = "." + strings.ToLower(name)
+	match := ""
+	for _, suffix := range s {
+		if len(suffix) > len(match) && strings.HasSuffix(name, suffix) {
+			match = suffix
 		}
 	}
-	return ""
+	return match
+}
+
+// MatchSubdomain reports whether the FQDN (with trailing dot) name is a subdomain of any suffix, the suffix itself doesn't match.
+func (s DomainSuffixes) MatchSubdomain(name string) bool {
+	name = strings.ToLower(name)
+	return slices.ContainsFunc(s, func(suffix string) bool { return strings.HasSuffix(name, suffix) })
 }
 
-func (c *Config) init() {
+type Hosts []string
+
+func (c *RoutingDynamicConfig) init() {
+	hosts := map[string][]hostPattern{}
+	for iface, patterns := range c.Hosts {
+		for _, s := range patterns {
+			if _, _, ok := geoSiteRef(s); ok {
+				continue // resolved to file hosts
+			}
+			// invalid patterns are skipped as they are reported by config validation
+			if pattern, err := parseHostPattern(s); err == nil {
+				hosts[iface] = append(hosts[iface], pattern)
+			}
+		}
+	}
+	for iface, patterns := range c.fileHosts {
+		hosts[iface] = append(hosts[iface], patterns...)
+	}
+	c.hostsTrie = newDomainTrie(hosts, c.InterfacePriority)
+
+	c.staticAddrs = map[string][]IPv4{}
+	for iface, addresses := range c.Static {
+		for _, addr := range addresses {
+			if _, ok := geoIPRef(addr); ok {
+				continue
+			}
+			if ip, err := ParseIPv4(addr); err == nil {
+				c.staticAddrs[iface] = append(c.staticAddrs[iface], ip)
+			}
+		}
+	}
+	for iface, addresses := range c.fileStatic {
+		c.staticAddrs[iface] = append(c.staticAddrs[iface], addresses...)
+	}
+}
+
+// loadFiles loads host lists and geo data referenced by the config, relative paths are resolved against the dir.
+func (c *RoutingDynamicConfig) loadFiles(dir string) error {
+	c.fileHosts = map[string][]hostPattern{}
+	c.fileStatic = map[string][]IPv4{}
+	c.geoSiteSkipped = map[string]int{}
+	if err := c.loadHostFiles(dir); err != nil {
+		return err
+	}
+	return c.loadGeoData(dir)
+}
+
+// LookupHost returns interface the host is routed to, the most specific matching pattern wins
+// and the interface priority resolves patterns listed for several interfaces.
+// Hosts are not routed until the config is initialized.
+func (c *RoutingDynamicConfig) LookupHost(host string) (iface string) {
+	if c.hostsTrie == nil {
+		return ""
+	}
+	return c.hostsTrie.Lookup(normalizeName(host))
+}
+
+// StaticAddrs returns addresses and networks always routed to interfaces, geoip codes are resolved.
+func (c *RoutingDynamicConfig) StaticAddrs() map[string][]IPv4 {
+	return c.staticAddrs
+}
+
+// GeoSiteSkipped returns number of domains skipped by geosite category, as they can't be represented as host patterns.
+func (c *RoutingDynamicConfig) GeoSiteSkipped() map[string]int {
+	return c.geoSiteSkipped
+}
+
+// HostConflicts returns host patterns listed for several interfaces.
+func (c *RoutingDynamicConfig) HostConflicts() []HostConflict {
+	if c.hostsTrie == nil {
+		return nil
+	}
+	return c.hostsTrie.Conflicts()
+}
+
+func (c *Config) init() error {
 	c.setDefaults()
-	c.MDNS.normalize()
+	c.Routing.init()
+	if err := c.MDNS.Domains.normalize(); err != nil {
+		return fmt.Errorf("mdns.%w", err)
+	}
+	for i, fwd := range c.DNSForward {
+		if err := fwd.Domains.normalize(); err != nil {
+			return fmt.Errorf("dns_forward[%d].%w", i, err)
+		}
+	}
+	return nil
 }
 
 func (c *Config) setDefaults() {
 	if c.HTTPAddr == "" {
 		c.HTTPAddr = c.Addr
 	}
+	if len(c.Listeners.UDP.Addrs) == 0 {
+		c.Listeners.UDP.Addrs = []string{c.Addr}
+	}
+	if len(c.Listeners.TCP.Addrs) == 0 {
+		c.Listeners.TCP.Addrs = []string{c.Addr}
+	}
+	if len(c.DNSProviders) == 0 && c.DNSProvider != "" {
+		c.DNSProviders = []string{c.DNSProvider}
+	}
+}
+
+func (c *Config) validate() error {
+	if len(c.DNSProviders) == 0 {
+		return errors.New("no DNS providers configured")
+	}
+	switch c.DNSUpstream.Strategy {
+	case UpstreamStrategyFailover, UpstreamStrategyRace:
+	default:
+		return fmt.Errorf("unknown upstream strategy '%s'", c.DNSUpstream.Strategy)
+	}
+	if c.Listeners.TLS.Enabled && (c.Listeners.TLS.CertFile == "" || c.Listeners.TLS.KeyFile == "") {
+		return errors.New("listeners.tls: cert_file and key_file must be specified")
+	}
+	for i, fwd := range c.DNSForward {
+		if len(fwd.Domains) == 0 || len(fwd.Providers) == 0 {
+			return fmt.Errorf("dns_forward[%d]: both domains and providers must be specified", i)
+		}
+	}
+	if c.History.Dir != "" && c.History.SegmentSize <= 0 {
+		return fmt.Errorf("history: segment_size must be positive, got %d", c.History.SegmentSize)
+	}
+	if c.History.MaxSize < 0 || c.History.MaxAge < 0 {
+		return errors.New("history: max_size and max_age must not be negative")
+	}
+	if err := c.DNSUpstream.validate(); err != nil {
+		return fmt.Errorf("dns_upstream: %w", err)
+	}
+	if err := c.DNSCache.validate(); err != nil {
+		return fmt.Errorf("dns_cache: %w", err)
+	}
+	return c.Routing.validate()
+}
+
+func (c *DNSUpstreamConfig) validate() error {
+	durations := []struct {
+		name string
+		val  time.Duration
+	}{
+		{"hedge_delay", c.HedgeDelay},
+		{"attempt_timeout", c.AttemptTimeout},
+		{"cooldown", c.Cooldown},
+	}
+	for _, d := range durations {
+		if d.val < 0 {
+			return fmt.Errorf("%s must not be negative, got %s", d.name, d.val)
+		}
+	}
+	if c.FailureThreshold < 0 {
+		return fmt.Errorf("failure_threshold must not be negative, got %d", c.FailureThreshold)
+	}
+	return nil
+}
+
+func (c *DNSCacheConfig) validate() error {
+	durations := []struct {
+		name string
+		val  time.Duration
+	}{
+		{"negative_max_ttl", c.NegativeMaxTTL},
+		{"stale_ttl", c.StaleTTL},
+		{"stale_answer_ttl", c.StaleAnswerTTL},
+		{"stale_answer_timeout", c.StaleAnswerTimeout},
+	}
+	for _, d := range durations {
+		if d.val < 0 {
+			return fmt.Errorf("%s must not be negative, got %s", d.name, d.val)
+		}
+	}
+	if c.MaxEntries < 0 || c.PrefetchMinHits < 0 {
+		return errors.New("max_entries and prefetch_min_hits must not be negative")
+	}
+	return nil
 }
 
-func (c *MDNSConfig) normalize() {
-	for i := range c.Domains {
-		c.Domains[i] = "." + strings.Trim(c.Domains[i], ".") + "."
+func (c *RoutingDynamicConfig) validate() error {
+	for _, iface := range slices.Sorted(maps.Keys(c.Hosts)) {
+		for i, pattern := range c.Hosts[iface] {
+			if _, _, ok := geoSiteRef(pattern); ok {
+				continue
+			}
+			if _, err := parseHostPattern(pattern); err != nil {
+				return fmt.Errorf("routing.hosts.%s[%d]: invalid pattern '%s': %w", iface, i, pattern, err)
+			}
+		}
+	}
+	for _, iface := range slices.Sorted(maps.Keys(c.Static)) {
+		for i, addr := range c.Static[iface] {
+			if _, ok := geoIPRef(addr); ok {
+				continue
+			}
+			if _, err := ParseIPv4(addr); err != nil {
+				return fmt.Errorf("routing.static.%s[%d]: %w", iface, i, err)
+			}
+		}
 	}
+	return nil
 }
 
 func DefaultConfig() *Config {
 	cfg := defaultConfig()
-	cfg.init()
+	if err := cfg.init(); err != nil {
+		panic(fmt.Errorf("failed to init default config: %w", err))
+	}
 	return cfg
 }
 
@@ -117,7 +387,15 @@ func LoadConfig(file string) (*Config, error) {
 	if err = yaml.NewDecoder(f).Decode(cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
-	cfg.init()
+	if err = cfg.Routing.loadFiles(filepath.Dir(file)); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if err = cfg.init(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if err = cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
 	return cfg, nil
 }
 
@@ -12,3 +12,38 @@ func getDNSQueryRemoteAddr(ctx context.Context) string {
 	addr, _ := ctx.Value(contextKeyDNSQueryRemoteAddr{}).(string)
 	return addr
 }
+
+// dnsQueryInfo collects details about how the query was resolved by resolvers down the chain.
+type dnsQueryInfo struct {
+	cached   bool
+	upstream string
+}
+
+type contextKeyDNSQueryInfo struct{}
+
+func withDNSQueryInfo(ctx context.Context) (context.Context, *dnsQueryInfo) {
+	info := &dnsQueryInfo{}
+	return context.WithValue(ctx, contextKeyDNSQueryInfo{}, info), info
+}
+
+func getDNSQueryInfo(ctx context.Context) *dnsQueryInfo {
+	info, _ := ctx.Value(contextKeyDNSQueryInfo{}).(*dnsQueryInfo)
+	return info
+}
+
+func setDNSQueryUpstream(ctx context.Context, upstream string) {
+	if info := getDNSQueryInfo(ctx); info != nil {
+		info.upstream = upstream
+	}
+}
+
+// withoutDNSQueryInfo hides query info from resolvers running concurrently on behalf of the same query.
+func withoutDNSQueryInfo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contextKeyDNSQueryInfo{}, (*dnsQueryInfo)(nil))
+}
+
+// detachContext returns context for background work started by the query,
+// which is not cancelled with the query and does not report to its query info.
+func detachContext(ctx context.Context) context.Context {
+	return withoutDNSQueryInfo(context.WithoutCancel(ctx))
+}
@@ -1,72 +1,367 @@
 package internal
 
 import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
+	"os"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/miekg/dns"
+
+	"github.com/mikhailv/keenetic-dns/dns-server/internal/metrics"
 )
 
+// DNSCache is LRU cache of DNS responses bounded by number of entries.
 type DNSCache struct {
-	mu      sync.RWMutex
-	entries map[dns.Question]dnsCacheEntry
+	cfg     DNSCacheConfig
+	mu      sync.Mutex
+	entries map[dnsCacheKey]*list.Element
+	lru     list.List // of *dnsCacheEntry, the most recently used entries are in front
 }
 
-func NewDNSCache() *DNSCache {
-	return &DNSCache{entries: map[dns.Question]dnsCacheEntry{}}
+type dnsCacheStatus int
+
+const (
+	dnsCacheMiss dnsCacheStatus = iota
+	dnsCacheHit
+	dnsCacheHitPrefetch // entry is about to expire and should be refreshed in background
+	dnsCacheStale       // entry is expired, but still can be served if upstream fails (RFC 8767)
+)
+
+// prefetchThreshold is the fraction of original TTL remaining when popular entries are refreshed.
+const prefetchThreshold = 0.1
+
+func NewDNSCache(cfg DNSCacheConfig) *DNSCache {
+	return &DNSCache{cfg: cfg, entries: map[dnsCacheKey]*list.Element{}}
 }
 
-func (s *DNSCache) Get(query dns.Question) *dns.Msg {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	if entry, ok := s.entries[query]; ok && !entry.Expired() {
-		return entry.Result()
+// Get returns cached response to the single question request, the response has no OPT record,
+// it must be added according to the request EDNS state.
+func (s *DNSCache) Get(req *dns.Msg) (*dns.Msg, dnsCacheStatus) {
+	key := cacheKey(req)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, dnsCacheMiss
 	}
-	return nil
+	entry := cacheEntry(el)
+	s.lru.MoveToFront(el)
+	if entry.Expired(0) {
+		if s.cfg.StaleTTL > 0 && !entry.Expired(s.cfg.StaleTTL) {
+			return entry.result(uint32(s.cfg.StaleAnswerTTL.Seconds())), dnsCacheStale
+		}
+		return nil, dnsCacheMiss
+	}
+	entry.hits++
+	if s.shouldPrefetch(entry) {
+		entry.prefetching = true
+		return entry.Result(), dnsCacheHitPrefetch
+	}
+	return entry.Result(), dnsCacheHit
 }
 
-func (s *DNSCache) Put(query dns.Question, result *dns.Msg) {
-	if len(result.Answer) == 0 {
+func (s *DNSCache) shouldPrefetch(entry *dnsCacheEntry) bool {
+	if s.cfg.PrefetchMinHits <= 0 || entry.hits < s.cfg.PrefetchMinHits || entry.prefetching {
+		return false
+	}
+	return time.Until(entry.expires) < time.Duration(prefetchThreshold*float64(entry.ttl))
+}
+
+// resetPrefetch allows entry of the request to be prefetched again after failed refresh.
+func (s *DNSCache) resetPrefetch(req *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[cacheKey(req)]; ok {
+		cacheEntry(el).prefetching = false
+	}
+}
+
+func (s *DNSCache) Put(req *dns.Msg, result *dns.Msg) {
+	ttl, ok := s.cacheTTL(result)
+	if !ok {
+		return
+	}
+	key := cacheKey(req)
+	msg := result.Copy()
+	msg.Extra = removeOPT(msg.Extra) // OPT record describes EDNS state of the upstream exchange, not of the cached data
+	entry := &dnsCacheEntry{key: key, msg: *msg, ttl: ttl, expires: time.Now().Add(ttl)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[key]; ok {
+		el.Value = entry
+		s.lru.MoveToFront(el)
 		return
 	}
-	minTTL := math.MaxInt
-	for _, rec := range result.Answer {
-		if ttl := int(rec.Header().Ttl); ttl > 0 && ttl < minTTL {
-			minTTL = ttl
+	s.entries[key] = s.lru.PushFront(entry)
+	for s.cfg.MaxEntries > 0 && s.lru.Len() > s.cfg.MaxEntries {
+		s.remove(s.lru.Back())
+		metrics.TrackStatus("dns.cache", "evicted")
+	}
+	metrics.SetDNSCacheEntries(s.lru.Len())
+}
+
+func (s *DNSCache) remove(el *list.Element) {
+	delete(s.entries, cacheEntry(el).key)
+	s.lru.Remove(el)
+}
+
+func (s *DNSCache) cacheTTL(result *dns.Msg) (time.Duration, bool) {
+	switch {
+	case result.Rcode == dns.RcodeSuccess && len(result.Answer) > 0:
+		minTTL := math.MaxInt
+		for _, rec := range result.Answer {
+			if ttl := int(rec.Header().Ttl); ttl > 0 && ttl < minTTL {
+				minTTL = ttl
+			}
 		}
+		return time.Duration(minTTL) * time.Second, minTTL < math.MaxInt
+	case result.Rcode == dns.RcodeNameError || result.Rcode == dns.RcodeSuccess: // NXDOMAIN or NODATA
+		return s.negativeCacheTTL(result)
+	default:
+		return 0, false
 	}
-	if minTTL < math.MaxInt {
-		s.mu.Lock()
-		defer s.mu.Unlock()
-		s.entries[query] = dnsCacheEntry{*result.Copy(), time.Now().Add(time.Duration(minTTL) * time.Second)}
+}
+
+// negativeCacheTTL returns TTL of negative response according to RFC 2308,
+// responses without SOA record in authority section must not be cached.
+func (s *DNSCache) negativeCacheTTL(result *dns.Msg) (time.Duration, bool) {
+	for _, rr := range result.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+			if s.cfg.NegativeMaxTTL > 0 {
+				ttl = min(ttl, s.cfg.NegativeMaxTTL)
+			}
+			return ttl, ttl > 0
+		}
 	}
+	return 0, false
 }
 
 func (s *DNSCache) RemoveExpired() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for k, v := range s.entries {
-		if v.Expired() {
-			delete(s.entries, k)
+	for el := s.lru.Front(); el != nil; {
+		next := el.Next()
+		if cacheEntry(el).Expired(s.cfg.StaleTTL) {
+			s.remove(el)
+		}
+		el = next
+	}
+	metrics.SetDNSCacheEntries(s.lru.Len())
+}
+
+type DNSCacheEntry struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Rcode   string   `json:"rcode"`
+	TTL     int      `json:"ttl"`
+	Stale   bool     `json:"stale,omitempty"`
+	DNSSEC  bool     `json:"dnssec,omitempty"` // response to DNSSEC OK query
+	Hits    int      `json:"hits"`
+	Answers []string `json:"answers,omitempty"`
+}
+
+// Entries returns up to count cache entries in the most recently used order, whose name contains search string.
+func (s *DNSCache) Entries(search string, count int) []DNSCacheEntry {
+	search = strings.ToLower(search)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]DNSCacheEntry, 0, min(count, s.lru.Len()))
+	for el := s.lru.Front(); el != nil && len(res) < count; el = el.Next() {
+		entry := cacheEntry(el)
+		if search != "" && !strings.Contains(entry.key.Name, search) {
+			continue
+		}
+		ttl := time.Until(entry.expires)
+		answers := make([]string, 0, len(entry.msg.Answer))
+		for _, rr := range entry.msg.Answer {
+			answers = append(answers, dns.TypeToString[rr.Header().Rrtype]+" "+rrData(rr))
+		}
+		res = append(res, DNSCacheEntry{
+			Name:    entry.key.Name,
+			Type:    dns.TypeToString[entry.key.Qtype],
+			DNSSEC:  entry.key.DO,
+			Rcode:   dns.RcodeToString[entry.msg.Rcode],
+			TTL:     int(ttl.Seconds()),
+			Stale:   ttl < 0,
+			Hits:    entry.hits,
+			Answers: answers,
+		})
+	}
+	return res
+}
+
+// Flush removes all entries and returns number of removed entries.
+func (s *DNSCache) Flush() int {
+	return s.removeFunc(func(dns.Question) bool { return true })
+}
+
+// FlushName removes entries of all types for the domain name normalized by normalizeDomain.
+func (s *DNSCache) FlushName(name string) int {
+	name = dns.Fqdn(name)
+	return s.removeFunc(func(q dns.Question) bool { return strings.EqualFold(q.Name, name) })
+}
+
+// FlushSuffix removes entries for the domain normalized by normalizeDomain and all its subdomains.
+func (s *DNSCache) FlushSuffix(suffix string) int {
+	suffixes := DomainSuffixes{"." + suffix + "."}
+	return s.removeFunc(func(q dns.Question) bool { return suffixes.Match(q.Name) != "" })
+}
+
+func (s *DNSCache) removeFunc(predicate func(q dns.Question) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for el := s.lru.Front(); el != nil; {
+		next := el.Next()
+		if predicate(cacheEntry(el).key.Question) {
+			s.remove(el)
+			removed++
+		}
+		el = next
+	}
+	metrics.SetDNSCacheEntries(s.lru.Len())
+	return removed
+}
+
+type dnsCacheRecord struct {
+	Query   dns.Question `json:"query"`
+	DO      bool         `json:"do,omitempty"`
+	Msg     []byte       `json:"msg"` // DNS wire format
+	TTL     uint32       `json:"ttl"`
+	Expires time.Time    `json:"expires"`
+}
+
+func (s *DNSCache) Load(file string) error {
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open dump file: %w", err)
+	}
+	defer f.Close()
+	var records []dnsCacheRecord
+	if err := json.NewDecoder(f).Decode(&records); err != nil {
+		return fmt.Errorf("failed to load DNS cache: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// records are saved from the most to the least recently used, so restore them in reverse order
+	for _, rec := range slices.Backward(records) {
+		var msg dns.Msg
+		if err := msg.Unpack(rec.Msg); err != nil || time.Now().After(rec.Expires) {
+			continue
+		}
+		key := dnsCacheKey{rec.Query, rec.DO}
+		key.Name = strings.ToLower(key.Name)
+		msg.Extra = removeOPT(msg.Extra)
+		if el, ok := s.entries[key]; ok {
+			s.remove(el)
+		}
+		ttl := time.Duration(rec.TTL) * time.Second
+		s.entries[key] = s.lru.PushFront(&dnsCacheEntry{key: key, msg: msg, ttl: ttl, expires: rec.Expires})
+	}
+	for s.cfg.MaxEntries > 0 && s.lru.Len() > s.cfg.MaxEntries {
+		s.remove(s.lru.Back())
+	}
+	metrics.SetDNSCacheEntries(s.lru.Len())
+	return nil
+}
+
+func (s *DNSCache) Save(file string) error {
+	records, err := s.records()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create dump file: %w", err)
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(records); err != nil {
+		return fmt.Errorf("failed to save DNS cache to dump file: %w", err)
+	}
+	return nil
+}
+
+func (s *DNSCache) records() ([]dnsCacheRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]dnsCacheRecord, 0, s.lru.Len())
+	for el := s.lru.Front(); el != nil; el = el.Next() {
+		entry := cacheEntry(el)
+		if entry.Expired(0) {
+			continue
+		}
+		msg, err := entry.msg.Pack()
+		if err != nil {
+			return nil, fmt.Errorf("failed to pack DNS message: %w", err)
 		}
+		records = append(records, dnsCacheRecord{entry.key.Question, entry.key.DO, msg, uint32(entry.ttl.Seconds()), entry.expires})
 	}
+	return records, nil
+}
+
+// dnsCacheKey identifies cached response, responses to DNSSEC OK queries carry signatures,
+// so they are cached separately from responses to queries without DO bit.
+type dnsCacheKey struct {
+	dns.Question
+	DO bool
+}
+
+// cacheKey returns key of the single question request, the name is lowercased,
+// so that names differing only in case share cache entry.
+func cacheKey(req *dns.Msg) dnsCacheKey {
+	key := dnsCacheKey{Question: req.Question[0]}
+	key.Name = strings.ToLower(key.Name)
+	if opt := req.IsEdns0(); opt != nil {
+		key.DO = opt.Do()
+	}
+	return key
+}
+
+func cacheEntry(el *list.Element) *dnsCacheEntry {
+	return el.Value.(*dnsCacheEntry) //nolint:errcheck // no need to check type
 }
 
 type dnsCacheEntry struct {
-	result  dns.Msg
-	expires time.Time
+	key         dnsCacheKey
+	msg         dns.Msg
+	ttl         time.Duration
+	expires     time.Time
+	hits        int
+	prefetching bool
+}
+
+func (s *dnsCacheEntry) Expired(extraTTL time.Duration) bool {
+	return time.Now().After(s.expires.Add(extraTTL))
 }
 
-func (s dnsCacheEntry) Expired() bool {
-	return time.Now().After(s.expires)
+func (s *dnsCacheEntry) Result() *dns.Msg {
+	return s.result(uint32(time.Until(s.expires).Seconds()))
 }
 
-func (s dnsCacheEntry) Result() *dns.Msg {
-	res := s.result.Copy()
-	ttl := max(1, uint32(time.Until(s.expires).Seconds()))
+func (s *dnsCacheEntry) result(ttl uint32) *dns.Msg {
+	res := s.msg.Copy()
+	ttl = max(1, ttl)
 	for i := range res.Answer {
 		res.Answer[i].Header().Ttl = ttl
 	}
+	for _, section := range [][]dns.RR{res.Ns, res.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl = min(hdr.Ttl, ttl)
+			}
+		}
+	}
 	return res
 }
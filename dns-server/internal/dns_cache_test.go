@@ -0,0 +1,382 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestQuery(name string, qtype uint16, do bool) *dns.Msg {
+	req := new(dns.Msg).SetQuestion(name, qtype)
+	if do {
+		req.SetEdns0(dnsUDPBufferSize, true)
+	}
+	return req
+}
+
+// newTestAnswer returns response with A records of the given TTLs.
+func newTestAnswer(req *dns.Msg, ttls ...uint32) *dns.Msg {
+	resp := new(dns.Msg).SetReply(req)
+	for i, ttl := range ttls {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IPv4(10, 0, 0, byte(i+1)),
+		})
+	}
+	return resp
+}
+
+// newTestNegativeAnswer returns NXDOMAIN or NODATA response with SOA record of the given TTL and minimum TTL.
+func newTestNegativeAnswer(req *dns.Msg, rcode int, ttl, minTTL uint32) *dns.Msg {
+	resp := new(dns.Msg).SetRcode(req, rcode)
+	resp.Ns = append(resp.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:     "ns.example.com.",
+		Mbox:   "admin.example.com.",
+		Minttl: minTTL,
+	})
+	return resp
+}
+
+// expireTestEntry moves expiration of the cached entry of the request back in time.
+func expireTestEntry(t *testing.T, cache *DNSCache, req *dns.Msg, by time.Duration) {
+	t.Helper()
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	el, ok := cache.entries[cacheKey(req)]
+	if !ok {
+		t.Fatalf("no cache entry for %s", req.Question[0].Name)
+	}
+	cacheEntry(el).expires = cacheEntry(el).expires.Add(-by)
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	req := newTestQuery("example.com.", dns.TypeA, false)
+
+	tests := []struct {
+		name   string
+		resp   *dns.Msg
+		maxTTL time.Duration // negative_max_ttl
+		ttl    time.Duration // 0 if not cached
+	}{
+		{name: "minimal answer ttl", resp: newTestAnswer(req, 300, 60, 120), ttl: time.Minute},
+		{name: "zero ttl records are ignored", resp: newTestAnswer(req, 0, 60), ttl: time.Minute},
+		{name: "zero ttl answer", resp: newTestAnswer(req, 0)},
+		{name: "nxdomain uses soa minimum", resp: newTestNegativeAnswer(req, dns.RcodeNameError, 3600, 300), ttl: 5 * time.Minute},
+		{name: "nodata uses soa ttl", resp: newTestNegativeAnswer(req, dns.RcodeSuccess, 60, 300), ttl: time.Minute},
+		{name: "negative max ttl", resp: newTestNegativeAnswer(req, dns.RcodeNameError, 3600, 3600), maxTTL: time.Minute, ttl: time.Minute},
+		{name: "nxdomain without soa", resp: new(dns.Msg).SetRcode(req, dns.RcodeNameError)},
+		{name: "nodata without soa", resp: newTestAnswer(req)},
+		{name: "servfail", resp: newTestNegativeAnswer(req, dns.RcodeServerFailure, 60, 60)},
+		{name: "refused", resp: new(dns.Msg).SetRcode(req, dns.RcodeRefused)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewDNSCache(DNSCacheConfig{NegativeMaxTTL: tt.maxTTL})
+			cache.Put(req, tt.resp)
+			res, status := cache.Get(req)
+			if tt.ttl == 0 {
+				if status != dnsCacheMiss {
+					t.Fatalf("got status %d, want miss", status)
+				}
+				return
+			}
+			if status != dnsCacheHit {
+				t.Fatalf("got status %d, want hit", status)
+			}
+			if res.Rcode != tt.resp.Rcode || len(res.Answer) != len(tt.resp.Answer) || len(res.Ns) != len(tt.resp.Ns) {
+				t.Errorf("got response %v, want %v", res, tt.resp)
+			}
+			if got := cache.Entries("", 1)[0].TTL; got < int(tt.ttl.Seconds())-1 || got > int(tt.ttl.Seconds()) {
+				t.Errorf("got ttl %d, want %d", got, int(tt.ttl.Seconds()))
+			}
+		})
+	}
+}
+
+func TestDNSCacheKey(t *testing.T) {
+	cache := NewDNSCache(DNSCacheConfig{})
+	cache.Put(newTestQuery("Example.COM.", dns.TypeA, false), newTestAnswer(newTestQuery("Example.COM.", dns.TypeA, false), 60))
+	cache.Put(newTestQuery("example.com.", dns.TypeMX, false), newTestNegativeAnswer(newTestQuery("example.com.", dns.TypeMX, false), dns.RcodeSuccess, 60, 60))
+
+	tests := []struct {
+		req    *dns.Msg
+		status dnsCacheStatus
+	}{
+		{newTestQuery("example.com.", dns.TypeA, false), dnsCacheHit},
+		{newTestQuery("EXAMPLE.com.", dns.TypeA, false), dnsCacheHit},
+		{newTestQuery("example.com.", dns.TypeMX, false), dnsCacheHit},
+		{newTestQuery("example.com.", dns.TypeAAAA, false), dnsCacheMiss},
+		{newTestQuery("www.example.com.", dns.TypeA, false), dnsCacheMiss},
+		{newTestQuery("example.com.", dns.TypeA, true), dnsCacheMiss}, // DNSSEC OK responses are cached separately
+	}
+	for _, tt := range tests {
+		res, status := cache.Get(tt.req)
+		if status != tt.status {
+			t.Errorf("Get(%s %s, do %v) status %d, want %d",
+				tt.req.Question[0].Name, dns.TypeToString[tt.req.Question[0].Qtype], tt.req.IsEdns0() != nil, status, tt.status)
+		}
+		if res != nil && res.IsEdns0() != nil {
+			t.Errorf("cached response has OPT record: %v", res)
+		}
+	}
+}
+
+func TestDNSCacheLRU(t *testing.T) {
+	cache := NewDNSCache(DNSCacheConfig{MaxEntries: 2})
+	put := func(name string) {
+		req := newTestQuery(name, dns.TypeA, false)
+		cache.Put(req, newTestAnswer(req, 60))
+	}
+	get := func(name string) dnsCacheStatus {
+		_, status := cache.Get(newTestQuery(name, dns.TypeA, false))
+		return status
+	}
+
+	put("a.example.com.")
+	put("b.example.com.")
+	get("a.example.com.") // a is the most recently used now
+	put("c.example.com.")
+
+	if get("b.example.com.") != dnsCacheMiss {
+		t.Error("least recently used entry wasn't evicted")
+	}
+	if get("a.example.com.") != dnsCacheHit || get("c.example.com.") != dnsCacheHit {
+		t.Error("recently used entries were evicted")
+	}
+
+	put("c.example.com.") // replacing existing entry doesn't evict anything
+	if get("a.example.com.") != dnsCacheHit {
+		t.Error("entry was evicted on replace")
+	}
+}
+
+func TestDNSCacheExpiry(t *testing.T) {
+	req := newTestQuery("example.com.", dns.TypeA, false)
+	positive := newTestAnswer(req, 60)
+	negative := newTestNegativeAnswer(req, dns.RcodeNameError, 60, 60)
+
+	tests := []struct {
+		name     string
+		resp     *dns.Msg
+		staleTTL time.Duration
+		expireBy time.Duration
+		status   dnsCacheStatus
+		removed  bool // by RemoveExpired
+	}{
+		{name: "fresh", resp: positive, staleTTL: time.Hour, expireBy: 30 * time.Second, status: dnsCacheHit},
+		{name: "expired", resp: positive, expireBy: 61 * time.Second, status: dnsCacheMiss, removed: true},
+		{name: "stale", resp: positive, staleTTL: time.Hour, expireBy: 30 * time.Minute, status: dnsCacheStale},
+		{name: "stale expired", resp: positive, staleTTL: time.Hour, expireBy: 2 * time.Hour, status: dnsCacheMiss, removed: true},
+		{name: "negative fresh", resp: negative, staleTTL: time.Hour, expireBy: 30 * time.Second, status: dnsCacheHit},
+		{name: "negative expired", resp: negative, expireBy: 61 * time.Second, status: dnsCacheMiss, removed: true},
+		{name: "negative stale", resp: negative, staleTTL: time.Hour, expireBy: 30 * time.Minute, status: dnsCacheStale},
+		{name: "negative stale expired", resp: negative, staleTTL: time.Hour, expireBy: 2 * time.Hour, status: dnsCacheMiss, removed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewDNSCache(DNSCacheConfig{StaleTTL: tt.staleTTL, StaleAnswerTTL: 30 * time.Second})
+			cache.Put(req, tt.resp)
+			expireTestEntry(t, cache, req, tt.expireBy)
+
+			res, status := cache.Get(req)
+			if status != tt.status {
+				t.Fatalf("got status %d, want %d", status, tt.status)
+			}
+			if status == dnsCacheStale {
+				// stale answer has short TTL, so that clients come back soon for the refreshed one
+				for _, rr := range append(res.Answer, res.Ns...) {
+					if rr.Header().Ttl != 30 {
+						t.Errorf("got stale ttl %d, want 30: %v", rr.Header().Ttl, rr)
+					}
+				}
+				if !cache.Entries("", 1)[0].Stale {
+					t.Error("entry isn't reported as stale")
+				}
+			}
+
+			cache.RemoveExpired()
+			if removed := len(cache.Entries("", 1)) == 0; removed != tt.removed {
+				t.Errorf("removed %v, want %v", removed, tt.removed)
+			}
+		})
+	}
+}
+
+func TestDNSCachePrefetch(t *testing.T) {
+	req := newTestQuery("example.com.", dns.TypeA, false)
+	cache := NewDNSCache(DNSCacheConfig{PrefetchMinHits: 2})
+	cache.Put(req, newTestAnswer(req, 100))
+
+	get := func(step string, want dnsCacheStatus) {
+		t.Helper()
+		if _, status := cache.Get(req); status != want {
+			t.Errorf("%s: got status %d, want %d", step, status, want)
+		}
+	}
+	get("first hit", dnsCacheHit)
+	get("popular, but not about to expire", dnsCacheHit)
+	expireTestEntry(t, cache, req, 95*time.Second)
+	get("about to expire", dnsCacheHitPrefetch)
+	get("prefetch in progress", dnsCacheHit)
+	cache.resetPrefetch(req)
+	get("prefetch failed", dnsCacheHitPrefetch)
+	cache.Put(req, newTestAnswer(req, 100))
+	get("refreshed", dnsCacheHit)
+
+	cache = NewDNSCache(DNSCacheConfig{PrefetchMinHits: 2})
+	cache.Put(req, newTestAnswer(req, 100))
+	expireTestEntry(t, cache, req, 95*time.Second)
+	get("unpopular entry isn't prefetched", dnsCacheHit)
+}
+
+func TestCachedDNSResolverServeStale(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream *testResolver
+		stale    bool
+	}{
+		{name: "upstream answers", upstream: &testResolver{}},
+		{name: "upstream fails", upstream: &testResolver{err: errTestUpstream}, stale: true},
+		{name: "upstream servfail", upstream: &testResolver{rcode: dns.RcodeServerFailure}, stale: true},
+		{name: "upstream is too slow", upstream: &testResolver{delay: 200 * time.Millisecond}, stale: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestQuery("example.com.", dns.TypeA, false)
+			cache := NewDNSCache(DNSCacheConfig{StaleTTL: time.Hour, StaleAnswerTTL: 30 * time.Second})
+			cache.Put(req, newTestAnswer(req, 60))
+			expireTestEntry(t, cache, req, 2*time.Minute)
+			resolver := cachedDNSResolver{resolver: tt.upstream, cache: cache, staleAnswerTimeout: 50 * time.Millisecond}
+
+			ctx, info := withDNSQueryInfo(context.Background())
+			resp, err := resolver.Resolve(ctx, req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// test upstream answers without records, so the stale response is the one with the answer
+			if stale := len(resp.Answer) > 0; stale != tt.stale || info.cached != tt.stale {
+				t.Errorf("got stale %v, cached %v, want %v", stale, info.cached, tt.stale)
+			}
+			if resp.Id != req.Id {
+				t.Errorf("got id %d, want %d", resp.Id, req.Id)
+			}
+			if got := tt.upstream.calls.Load(); got != 1 {
+				t.Errorf("upstream called %d times, want 1", got)
+			}
+		})
+	}
+}
+
+func TestDNSCacheSaveLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dns-cache.json")
+	queries := map[string]*dns.Msg{
+		"expired":  newTestQuery("expired.example.com.", dns.TypeA, false),
+		"stale":    newTestQuery("stale.example.com.", dns.TypeA, false),
+		"negative": newTestQuery("negative.example.com.", dns.TypeAAAA, false),
+		"dnssec":   newTestQuery("Example.COM.", dns.TypeA, true),
+		"plain":    newTestQuery("example.com.", dns.TypeA, false),
+	}
+
+	cache := NewDNSCache(DNSCacheConfig{StaleTTL: time.Hour})
+	for _, name := range []string{"expired", "stale", "negative", "dnssec", "plain"} { // the last one is the most recently used
+		req := queries[name]
+		resp := newTestAnswer(req, 300)
+		if name == "negative" {
+			resp = newTestNegativeAnswer(req, dns.RcodeNameError, 60, 60)
+		}
+		if req.IsEdns0() != nil {
+			resp.SetEdns0(4096, true)
+		}
+		cache.Put(req, resp)
+	}
+	expireTestEntry(t, cache, queries["expired"], 2*time.Hour)
+	expireTestEntry(t, cache, queries["stale"], 10*time.Minute)
+
+	if err := cache.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewDNSCache(DNSCacheConfig{StaleTTL: time.Hour})
+	if err := loaded.Load(file); err != nil {
+		t.Fatal(err)
+	}
+
+	// expired entries are not saved, including stale ones
+	var got []string
+	for _, entry := range loaded.Entries("", 10) {
+		got = append(got, fmt.Sprintf("%s %s %v %s", entry.Name, entry.Type, entry.DNSSEC, entry.Rcode))
+	}
+	want := []string{
+		"example.com. A false NOERROR",
+		"example.com. A true NOERROR",
+		"negative.example.com. AAAA false NXDOMAIN",
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got entries %q, want %q", got, want)
+	}
+
+	for _, name := range []string{"plain", "dnssec", "negative"} {
+		res, status := loaded.Get(queries[name])
+		if status != dnsCacheHit {
+			t.Errorf("%s: got status %d, want hit", name, status)
+			continue
+		}
+		if res.IsEdns0() != nil {
+			t.Errorf("%s: loaded response has OPT record", name)
+		}
+		if answers := res.Answer; len(answers) > 0 && (answers[0].Header().Ttl < 299 || answers[0].Header().Ttl > 300) {
+			t.Errorf("%s: got ttl %d, want 300", name, answers[0].Header().Ttl)
+		}
+	}
+}
+
+func TestDNSCacheLoad(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewDNSCache(DNSCacheConfig{MaxEntries: 1})
+	if err := cache.Load(filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("missing file: unexpected error: %v", err)
+	}
+
+	broken := filepath.Join(dir, "broken.json")
+	if err := os.WriteFile(broken, []byte("[{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Load(broken); err == nil {
+		t.Error("broken file: expected error")
+	}
+
+	// entries expired since the dump was saved are dropped, as well as entries exceeding the limit
+	// starting from the least recently used
+	full := NewDNSCache(DNSCacheConfig{})
+	for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		req := newTestQuery(name, dns.TypeA, false)
+		full.Put(req, newTestAnswer(req, 60))
+	}
+	records, err := full.records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	records[0].Expires = time.Now().Add(-time.Second) // c.example.com.
+	data, err := json.Marshal(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "dns-cache.json")
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Load(file); err != nil {
+		t.Fatal(err)
+	}
+	if entries := cache.Entries("", 10); len(entries) != 1 || entries[0].Name != "b.example.com." {
+		t.Errorf("got entries %v, want b.example.com.", entries)
+	}
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -9,18 +10,34 @@ import (
 	"github.com/mikhailv/keenetic-dns/dns-server/internal/metrics"
 )
 
+// dnsUDPBufferSize is EDNS0 UDP payload size advertised by the server and used for upstream queries,
+// the value recommended by DNS flag day 2020 to avoid IP fragmentation.
+const dnsUDPBufferSize = 1232
+
 var _ DNSResolver = (*dnsClient)(nil)
 
 type dnsClient struct {
 	address string
-	client  dns.Client
+	tcpOnly bool
+	udp     dns.Client
+	tcp     dns.Client
 }
 
+// NewDNSClient creates plain DNS client for address in the form `[udp://|tcp://]host:port`,
+// UDP client falls back to TCP when the response is truncated.
 func NewDNSClient(address string, timeout time.Duration) DNSResolver {
+	address, tcpOnly := strings.CutPrefix(address, "tcp://")
+	address = strings.TrimPrefix(address, "udp://")
 	return &dnsClient{
 		address: address,
-		client: dns.Client{
+		tcpOnly: tcpOnly,
+		udp: dns.Client{
 			Net:     "udp",
+			UDPSize: dnsUDPBufferSize,
+			Timeout: timeout,
+		},
+		tcp: dns.Client{
+			Net:     "tcp",
 			Timeout: timeout,
 		},
 	}
@@ -28,6 +45,45 @@ func NewDNSClient(address string, timeout time.Duration) DNSResolver {
 
 func (c *dnsClient) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
 	defer metrics.TrackDuration("dns_client.resolve")()
-	resp, _, err := c.client.ExchangeContext(ctx, msg, c.address)
-	return resp, err
+
+	req := msg.Copy()
+	if opt := req.IsEdns0(); opt != nil {
+		opt.SetUDPSize(dnsUDPBufferSize)
+	} else {
+		req.SetEdns0(dnsUDPBufferSize, false)
+	}
+
+	if !c.tcpOnly {
+		resp, _, err := c.udp.ExchangeContext(ctx, req, c.address)
+		if err != nil || !resp.Truncated {
+			return c.response(msg, resp, err)
+		}
+		metrics.TrackStatus("dns_client.resolve", "truncated")
+	}
+
+	resp, _, err := c.tcp.ExchangeContext(ctx, req, c.address)
+	return c.response(msg, resp, err)
+}
+
+func (c *dnsClient) response(msg, resp *dns.Msg, err error) (*dns.Msg, error) {
+	if err != nil {
+		return nil, err
+	}
+	if msg.IsEdns0() == nil {
+		// client didn't ask for EDNS0, so do not return OPT record added to the upstream query
+		resp.Extra = removeOPT(resp.Extra)
+	} else if opt := resp.IsEdns0(); opt != nil {
+		opt.SetUDPSize(dnsUDPBufferSize)
+	}
+	return resp, nil
+}
+
+func removeOPT(rrs []dns.RR) []dns.RR {
+	res := rrs[:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			res = append(res, rr)
+		}
+	}
+	return res
 }
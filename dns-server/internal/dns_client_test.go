@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsTestServer answers over UDP and TCP on the same port, UDP responses are truncated when truncate is set.
+type dnsTestServer struct {
+	addr     string
+	truncate bool
+
+	mu      sync.Mutex
+	queries map[string][]*dns.Msg // by network
+}
+
+func startDNSTestServer(t *testing.T, truncate bool) *dnsTestServer {
+	t.Helper()
+	srv := &dnsTestServer{truncate: truncate, queries: map[string][]*dns.Msg{}}
+
+	var udpConn net.PacketConn
+	var tcpListener net.Listener
+	for attempt := 0; tcpListener == nil; attempt++ {
+		var err error
+		if udpConn, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		// the port could be already taken by another TCP listener, so try another one
+		if tcpListener, err = net.Listen("tcp", udpConn.LocalAddr().String()); err != nil {
+			_ = udpConn.Close()
+			if attempt == 10 {
+				t.Fatal(err)
+			}
+		}
+	}
+	srv.addr = udpConn.LocalAddr().String()
+
+	for _, server := range []*dns.Server{{PacketConn: udpConn, Handler: srv}, {Listener: tcpListener, Handler: srv}} {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go func() { _ = server.ActivateAndServe() }()
+		<-started
+		t.Cleanup(func() { _ = server.Shutdown() })
+	}
+	return srv
+}
+
+func (s *dnsTestServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	network := w.LocalAddr().Network()
+	s.mu.Lock()
+	s.queries[network] = append(s.queries[network], req)
+	s.mu.Unlock()
+
+	resp := new(dns.Msg).SetReply(req)
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(4096, opt.Do())
+	}
+	if network == "udp" && s.truncate {
+		resp.Truncated = true
+	} else {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(10, 0, 0, 1),
+		})
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func (s *dnsTestServer) received(network string) []*dns.Msg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[network]
+}
+
+func TestDNSClientTCPFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		scheme   string
+		truncate bool
+		udp, tcp int // number of queries received by the server
+	}{
+		{name: "udp", udp: 1},
+		{name: "udp scheme", scheme: "udp://", udp: 1},
+		{name: "truncated response is retried over tcp", truncate: true, udp: 1, tcp: 1},
+		{name: "tcp only", scheme: "tcp://", truncate: true, tcp: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := startDNSTestServer(t, tt.truncate)
+			client := NewDNSClient(tt.scheme+srv.addr, time.Second)
+
+			resp, err := client.Resolve(context.Background(), new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.Truncated || len(resp.Answer) != 1 {
+				t.Errorf("got truncated %v, answers %d, want complete response", resp.Truncated, len(resp.Answer))
+			}
+			if udp, tcp := len(srv.received("udp")), len(srv.received("tcp")); udp != tt.udp || tcp != tt.tcp {
+				t.Errorf("got %d udp and %d tcp queries, want %d and %d", udp, tcp, tt.udp, tt.tcp)
+			}
+		})
+	}
+}
+
+func TestDNSClientEDNS(t *testing.T) {
+	tests := []struct {
+		name    string
+		udpSize uint16 // 0 is query without OPT record
+		do      bool
+	}{
+		{name: "no edns"},
+		{name: "small buffer", udpSize: 512},
+		{name: "large buffer with do", udpSize: 4096, do: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := startDNSTestServer(t, false)
+			client := NewDNSClient(srv.addr, time.Second)
+
+			req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+			if tt.udpSize > 0 {
+				req.SetEdns0(tt.udpSize, tt.do)
+			}
+			resp, err := client.Resolve(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// upstream is always queried with EDNS0 and the server buffer size, DO bit is passed as is
+			queries := srv.received("udp")
+			if len(queries) != 1 {
+				t.Fatalf("got %d queries, want 1", len(queries))
+			}
+			opt := queries[0].IsEdns0()
+			if opt == nil || opt.UDPSize() != dnsUDPBufferSize || opt.Do() != tt.do {
+				t.Errorf("upstream query OPT %v, want udp size %d and do %v", opt, dnsUDPBufferSize, tt.do)
+			}
+			if req.IsEdns0() != nil && req.IsEdns0().UDPSize() != tt.udpSize {
+				t.Error("client query was modified")
+			}
+
+			// OPT record is returned only when client asked for EDNS0
+			opt = resp.IsEdns0()
+			if tt.udpSize == 0 && opt != nil {
+				t.Errorf("unexpected OPT in response: %v", opt)
+			}
+			if tt.udpSize > 0 && (opt == nil || opt.UDPSize() != dnsUDPBufferSize) {
+				t.Errorf("response OPT %v, want udp size %d", opt, dnsUDPBufferSize)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package internal
 import (
 	"context"
 	"fmt"
+	"math"
 	"slices"
 	"strings"
 	"sync"
@@ -20,14 +21,15 @@ type DNSResolver interface {
 func NewSingleInflightDNSResolver(resolver DNSResolver) DNSResolver {
 	return &singleInflightResolver{
 		resolver: resolver,
-		requests: map[dns.Question]*inflightRequest{},
+		requests: map[dnsCacheKey]*inflightRequest{},
 	}
 }
 
 func NewCachedDNSResolver(resolver DNSResolver, cache *DNSCache) DNSResolver {
 	return &cachedDNSResolver{
-		resolver: resolver,
-		cache:    cache,
+		resolver:           resolver,
+		cache:              cache,
+		staleAnswerTimeout: cache.cfg.StaleAnswerTimeout,
 	}
 }
 
@@ -45,15 +47,16 @@ func NewVerboseDNSResolver(resolver DNSResolver) DNSResolver {
 var _ DNSResolver = (*singleInflightResolver)(nil)
 
 type inflightRequest struct {
-	Done chan struct{}
-	Resp *dns.Msg
-	Err  error
+	Done     chan struct{}
+	Resp     *dns.Msg
+	Err      error
+	Upstream string
 }
 
 type singleInflightResolver struct {
 	resolver DNSResolver
 	mu       sync.Mutex
-	requests map[dns.Question]*inflightRequest
+	requests map[dnsCacheKey]*inflightRequest
 }
 
 func (s *singleInflightResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
@@ -61,7 +64,7 @@ func (s *singleInflightResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dn
 		return s.resolver.Resolve(ctx, msg)
 	}
 
-	reqKey := msg.Question[0]
+	reqKey := cacheKey(msg)
 
 	s.mu.Lock()
 	if req := s.requests[reqKey]; req != nil {
@@ -71,9 +74,10 @@ func (s *singleInflightResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dn
 			return nil, ctx.Err()
 		case <-req.Done:
 			if req.Err == nil {
-				resp := msg.Copy()
-				resp.Response = true
-				resp.Answer = req.Resp.Answer
+				resp := req.Resp.Copy()
+				resp.Id, resp.Question = msg.Id, msg.Question
+				setResponseEDNS(msg, resp)
+				setDNSQueryUpstream(ctx, req.Upstream)
 				return resp, nil
 			}
 			// if we get error, then just ignore it and try to send another request
@@ -88,6 +92,9 @@ func (s *singleInflightResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dn
 	s.mu.Unlock()
 
 	req.Resp, req.Err = s.resolver.Resolve(ctx, msg)
+	if info := getDNSQueryInfo(ctx); info != nil {
+		req.Upstream = info.upstream
+	}
 	close(req.Done)
 
 	s.mu.Lock()
@@ -102,28 +109,88 @@ func (s *singleInflightResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dn
 var _ DNSResolver = cachedDNSResolver{}
 
 type cachedDNSResolver struct {
-	resolver DNSResolver
-	cache    *DNSCache
+	resolver           DNSResolver
+	cache              *DNSCache
+	staleAnswerTimeout time.Duration
 }
 
 func (s cachedDNSResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
 	defer metrics.TrackDuration("dns.cache.handle")()
-	if hasSingleQuestion(msg, dns.TypeA) {
-		query := msg.Question[0]
-		if resp := s.cache.Get(query); resp != nil {
-			metrics.TrackStatus("dns.cache", "hit")
-			resp.Id = msg.Id
-			return resp, nil
+	if !hasSingleQuestion(msg) || msg.CheckingDisabled {
+		return s.resolver.Resolve(ctx, msg)
+	}
+
+	resp, status := s.cache.Get(msg)
+	switch status {
+	case dnsCacheHit, dnsCacheHitPrefetch:
+		metrics.TrackStatus("dns.cache", "hit")
+		if status == dnsCacheHitPrefetch {
+			metrics.TrackStatus("dns.cache", "prefetch")
+			go s.prefetch(detachContext(ctx), msg.Copy())
 		}
-		metrics.TrackStatus("dns.cache", "miss")
-		resp, err := s.resolver.Resolve(ctx, msg)
-		if err == nil {
-			s.cache.Put(query, resp)
+		if info := getDNSQueryInfo(ctx); info != nil {
+			info.cached = true
 		}
-		return resp, err
+		resp.Id, resp.Question = msg.Id, msg.Question
+		setResponseEDNS(msg, resp)
+		return resp, nil
+	case dnsCacheStale:
+		metrics.TrackStatus("dns.cache", "miss")
+		resp.Id, resp.Question = msg.Id, msg.Question
+		setResponseEDNS(msg, resp)
+		return s.resolveOrServeStale(ctx, msg, resp)
+	default:
+		metrics.TrackStatus("dns.cache", "miss")
+		return s.resolve(ctx, msg)
+	}
+}
+
+func (s cachedDNSResolver) resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	resp, err := s.resolver.Resolve(ctx, msg)
+	if err == nil {
+		s.cache.Put(msg, resp)
+	}
+	return resp, err
+}
+
+// prefetch refreshes cache entry in background, if refresh fails the entry can be prefetched again on the next hit.
+func (s cachedDNSResolver) prefetch(ctx context.Context, msg *dns.Msg) {
+	if resp, err := s.resolve(ctx, msg); err != nil || resp.Rcode == dns.RcodeServerFailure {
+		metrics.TrackStatus("dns.cache", "prefetch_failed")
+		s.cache.resetPrefetch(msg)
 	}
+}
+
+// resolveOrServeStale waits for upstream response for limited time and serves stale response
+// if upstream fails or is too slow, the upstream request completes in background and refreshes cache.
+func (s cachedDNSResolver) resolveOrServeStale(ctx context.Context, msg, stale *dns.Msg) (*dns.Msg, error) {
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		resp, err := s.resolve(detachContext(ctx), msg)
+		resCh <- result{resp, err}
+	}()
 
-	return s.resolver.Resolve(ctx, msg)
+	timer := time.NewTimer(s.staleAnswerTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-resCh:
+		if res.err == nil && res.resp.Rcode != dns.RcodeServerFailure {
+			return res.resp, nil
+		}
+	case <-timer.C:
+	}
+	metrics.TrackStatus("dns.cache", "stale")
+	if info := getDNSQueryInfo(ctx); info != nil {
+		info.cached = true
+	}
+	return stale, nil
 }
 
 var _ DNSResolver = ttlOverridingDNSResolver{}
@@ -172,9 +239,37 @@ func indent(text string) string {
 	return "\t" + strings.Join(strings.Split(text, "\n"), "\n\t")
 }
 
+// setResponseEDNS replaces OPT record of the response with the one matching EDNS state of the request (RFC 6891).
+func setResponseEDNS(req, resp *dns.Msg) {
+	resp.Extra = removeOPT(resp.Extra)
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(dnsUDPBufferSize, opt.Do())
+	}
+}
+
 func hasSingleQuestion(msg *dns.Msg, types ...uint16) bool {
 	if len(msg.Question) != 1 {
 		return false
 	}
 	return len(types) == 0 || slices.Contains(types, msg.Question[0].Qtype)
 }
+
+// rrData returns text representation of resource record data without header.
+func rrData(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+func minResponseTTL(msg *dns.Msg) uint32 {
+	ttl, found := uint32(math.MaxUint32), false
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				ttl, found = min(ttl, rr.Header().Ttl), true
+			}
+		}
+	}
+	if !found {
+		return 0
+	}
+	return ttl
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mikhailv/keenetic-dns/dns-server/internal/metrics"
+)
+
+type DNSServer struct {
+	logger   *slog.Logger
+	resolver DNSResolver
+	cfg      DNSListenersConfig
+	servers  []*dns.Server
+}
+
+func NewDNSServer(cfg DNSListenersConfig, logger *slog.Logger, resolver DNSResolver) *DNSServer {
+	s := &DNSServer{
+		logger:   logger,
+		resolver: resolver,
+		cfg:      cfg,
+	}
+	s.addServers("udp", cfg.UDP)
+	s.addServers("tcp", cfg.TCP)
+	s.addServers("tcp-tls", cfg.TLS.DNSListenerConfig)
+	return s
+}
+
+func (s *DNSServer) addServers(network string, cfg DNSListenerConfig) {
+	if !cfg.Enabled {
+		return
+	}
+	for _, addr := range cfg.Addrs {
+		s.servers = append(s.servers, &dns.Server{
+			Addr:         addr,
+			Net:          network,
+			UDPSize:      dnsUDPBufferSize,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		})
+	}
+}
+
+func (s *DNSServer) Serve(ctx context.Context) {
+	handler := s.createHandler(ctx)
+
+	var tlsConfig *tls.Config
+	if s.cfg.TLS.Enabled {
+		cert, err := tls.LoadX509KeyPair(s.cfg.TLS.CertFile, s.cfg.TLS.KeyFile)
+		if err != nil {
+			s.logger.Error("failed to load TLS certificate", "err", err)
+			os.Exit(1)
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, server := range s.servers {
+		server.Handler = handler
+		server.TLSConfig = tlsConfig
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serve(ctx, server)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *DNSServer) serve(ctx context.Context, server *dns.Server) {
+	context.AfterFunc(ctx, func() {
+		s.logger.Info("shutting down server...", "net", server.Net, "addr", server.Addr)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.ShutdownContext(shutdownCtx); err != nil {
+			s.logger.Error("failed to shutdown server", "err", err, "net", server.Net, "addr", server.Addr)
+		}
+	})
+
+	s.logger.Info("server starting...", "net", server.Net, "addr", server.Addr)
+	if err := server.ListenAndServe(); err != nil {
+		s.logger.Error("failed to start server", "err", err, "net", server.Net, "addr", server.Addr)
+		os.Exit(1)
+	}
+}
+
+func (s *DNSServer) createHandler(ctx context.Context) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		defer metrics.TrackDuration("dns.handle")()
+		resp, err := s.resolver.Resolve(withDNSQueryRemoteAddr(ctx, w.RemoteAddr().String()), req)
+		if err != nil {
+			s.logger.Error("failed to handle request", "err", err)
+			resp = &dns.Msg{}
+			resp.SetRcode(req, dns.RcodeServerFailure)
+			metrics.TrackStatus("dns.handle", "failed")
+		} else {
+			metrics.TrackStatus("dns.handle", "success")
+		}
+		if w.LocalAddr().Network() == "udp" {
+			// set TC bit if the response does not fit, so the client retries over TCP
+			resp.Truncate(udpResponseSize(req))
+		}
+		_ = w.WriteMsg(resp)
+	})
+}
+
+func udpResponseSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil {
+		return int(min(max(opt.UDPSize(), dns.MinMsgSize), dnsUDPBufferSize))
+	}
+	return dns.MinMsgSize
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	_ "embed"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -18,20 +19,21 @@ import (
 	"strings"
 	"time"
 
-	"github.com/coder/websocket"
-	"github.com/coder/websocket/wsjson"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 
 	"github.com/mikhailv/keenetic-dns/dns-server/internal/metrics"
 	"github.com/mikhailv/keenetic-dns/dns-server/web/static"
+	"github.com/mikhailv/keenetic-dns/internal/filter"
 	"github.com/mikhailv/keenetic-dns/internal/log"
 	"github.com/mikhailv/keenetic-dns/internal/stream"
 )
 
 const (
 	dnsMessageMediaType = "application/dns-message"
+	dnsJSONMediaType    = "application/dns-json"
+	jsonMediaType       = "application/json"
 )
 
 type FilterFunc[T any] func(val T) bool
@@ -41,6 +43,8 @@ type HTTPServer struct {
 	resolver       DNSResolver
 	server         http.Server
 	ipRoutes       *IPRouteController
+	upstreams      []*Upstream
+	dnsCache       *DNSCache
 	logStream      *stream.Buffered[log.Entry]
 	queryStream    *stream.Buffered[DNSQuery]
 	rawQueryStream *stream.Buffered[DNSRawQuery]
@@ -51,6 +55,8 @@ func NewHTTPServer(
 	logger *slog.Logger,
 	resolver DNSResolver,
 	ipRoutes *IPRouteController,
+	upstreams []*Upstream,
+	dnsCache *DNSCache,
 	logStream *stream.Buffered[log.Entry],
 	queryStream *stream.Buffered[DNSQuery],
 	rawQueryStream *stream.Buffered[DNSRawQuery],
@@ -63,6 +69,8 @@ func NewHTTPServer(
 			ReadHeaderTimeout: 10 * time.Second,
 		},
 		ipRoutes:       ipRoutes,
+		upstreams:      upstreams,
+		dnsCache:       dnsCache,
 		logStream:      logStream,
 		queryStream:    queryStream,
 		rawQueryStream: rawQueryStream,
@@ -70,7 +78,7 @@ func NewHTTPServer(
 }
 
 func (s *HTTPServer) Serve(ctx context.Context) {
-	s.server.Handler = s.createHandler()
+	s.server.Handler = s.createHandler(ctx)
 
 	context.AfterFunc(ctx, func() {
 		s.logger.Info("shutting down server...")
@@ -88,67 +96,104 @@ func (s *HTTPServer) Serve(ctx context.Context) {
 	}
 }
 
-func (s *HTTPServer) createHandler() http.Handler {
+func (s *HTTPServer) createHandler(ctx context.Context) http.Handler {
 	wsLogger := log.WithPrefix(s.logger, "ws")
+	sseLogger := log.WithPrefix(s.logger, "sse")
 
 	mux := http.NewServeMux()
 	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.Handle("GET /dns-query", s.wrapHandler(s.handleDNSQuery))
 	mux.Handle("POST /dns-query", s.wrapHandler(s.handleDNSQuery))
 	mux.Handle("GET /api/routes", http.HandlerFunc(s.handleRoutes))
+	mux.Handle("GET /api/upstreams", http.HandlerFunc(s.handleUpstreams))
+	mux.Handle("GET /api/dns-cache", http.HandlerFunc(s.handleDNSCache))
+	mux.Handle("DELETE /api/dns-cache", http.HandlerFunc(s.handleDNSCacheFlush))
 	mux.Handle("GET /api/logs", createListHandler(s.logStream, s.filterLogs))
 	mux.Handle("GET /api/logs/ws", createStreamHandler(s.logStream, wsLogger, s.filterLogs))
+	mux.Handle("GET /api/logs/sse", createSSEHandler(ctx, s.logStream, sseLogger, s.filterLogs))
 	mux.Handle("GET /api/dns-queries", createListHandler(s.queryStream, s.filterQueries))
 	mux.Handle("GET /api/dns-queries/ws", createStreamHandler(s.queryStream, wsLogger, s.filterQueries))
+	mux.Handle("GET /api/dns-queries/sse", createSSEHandler(ctx, s.queryStream, sseLogger, s.filterQueries))
 	mux.Handle("GET /api/dns-raw-queries", createListHandler(s.rawQueryStream, s.filterRawQueries))
 	mux.Handle("GET /api/dns-raw-queries/ws", createStreamHandler(s.rawQueryStream, wsLogger, s.filterRawQueries))
+	mux.Handle("GET /api/dns-raw-queries/sse", createSSEHandler(ctx, s.rawQueryStream, sseLogger, s.filterRawQueries))
 	mux.Handle("GET /app.js", staticFileHandler("app.js"))
 	mux.Handle("GET /", staticFileHandler("index.html"))
 
 	return cors.Default().Handler(mux)
 }
 
-func (s *HTTPServer) filterLogs(_ *http.Request, query url.Values) FilterFunc[log.Entry] {
+func (s *HTTPServer) filterLogs(_ *http.Request, query url.Values) (FilterFunc[log.Entry], error) {
+	expr, err := filterExpr(query, log.EntryFilterFields, nil)
+	if err != nil {
+		return nil, err
+	}
 	levels := slices.DeleteFunc(strings.Split(query.Get("level"), ","), func(s string) bool { return s == "" })
 	if len(levels) == 0 {
-		return nil
+		return expr, nil
 	}
 	levelSet := map[string]bool{}
 	for _, level := range levels {
 		levelSet[level] = true
 	}
-	return func(val log.Entry) bool {
+	return allOf(expr, func(val log.Entry) bool {
 		return levelSet[val.Level]
-	}
+	}), nil
 }
 
-func (s *HTTPServer) filterQueries(_ *http.Request, query url.Values) FilterFunc[DNSQuery] {
-	domain := strings.TrimSpace(query.Get("domain"))
-	search := strings.TrimSpace(query.Get("search"))
-	excludeRouted := queryParamSet(query, "exclude_routed")
-	if domain == "" && search == "" && !excludeRouted {
-		return nil
+func (s *HTTPServer) filterQueries(_ *http.Request, query url.Values) (FilterFunc[DNSQuery], error) {
+	expr, err := filterExpr(query, dnsQueryFilterFields, dnsQueryFilterNormalizers)
+	if err != nil {
+		return nil, err
 	}
-	return func(val DNSQuery) bool {
-		if excludeRouted && s.ipRoutes.LookupHost(val.Domain) != "" {
-			return false
-		}
-		if search != "" && !strings.Contains(val.Domain, search) {
-			return false
-		}
-		if domain != "" && val.Domain != domain {
-			return false
-		}
-		return true
+	filters := []FilterFunc[DNSQuery]{expr}
+	domain, err := normalizeDomain(strings.TrimSpace(query.Get("domain")))
+	if err != nil {
+		return nil, err
+	}
+	if domain != "" {
+		filters = append(filters, func(val DNSQuery) bool { return val.Domain == domain })
+	}
+	search, err := normalizeDomain(strings.TrimSpace(query.Get("search")))
+	if err != nil {
+		return nil, err
+	}
+	if search != "" {
+		filters = append(filters, func(val DNSQuery) bool { return strings.Contains(val.Domain, search) })
+	}
+	if queryParamSet(query, "exclude_routed") {
+		filters = append(filters, func(val DNSQuery) bool { return s.ipRoutes.LookupHost(val.Domain) == "" })
+	}
+	if types := queryParamList(query, "type"); len(types) > 0 {
+		filters = append(filters, func(val DNSQuery) bool { return slices.Contains(types, val.Type) })
 	}
+	if rcodes := queryParamList(query, "rcode"); len(rcodes) > 0 {
+		filters = append(filters, func(val DNSQuery) bool { return slices.Contains(rcodes, val.Rcode) })
+	}
+	if upstream := strings.TrimSpace(query.Get("upstream")); upstream != "" {
+		filters = append(filters, func(val DNSQuery) bool { return val.Upstream == upstream })
+	}
+	if query.Has("cached") {
+		cached := queryParamSet(query, "cached")
+		filters = append(filters, func(val DNSQuery) bool { return val.Cached == cached })
+	}
+	if queryParamSet(query, "only_errors") {
+		filters = append(filters, func(val DNSQuery) bool { return val.Error != "" })
+	}
+	return allOf(filters...), nil
 }
 
-func (s *HTTPServer) filterRawQueries(_ *http.Request, query url.Values) FilterFunc[DNSRawQuery] {
+func (s *HTTPServer) filterRawQueries(_ *http.Request, query url.Values) (FilterFunc[DNSRawQuery], error) {
+	expr, err := filterExpr(query, dnsRawQueryFilterFields, nil)
+	if err != nil {
+		return nil, err
+	}
 	search := strings.TrimSpace(query.Get("search"))
 	onlyResponses := queryParamSet(query, "only_responses")
 	if search == "" && !onlyResponses {
-		return nil
+		return expr, nil
 	}
-	return func(val DNSRawQuery) bool {
+	return allOf(expr, func(val DNSRawQuery) bool {
 		if onlyResponses && !val.Response {
 			return false
 		}
@@ -156,7 +201,7 @@ func (s *HTTPServer) filterRawQueries(_ *http.Request, query url.Values) FilterF
 			return false
 		}
 		return true
-	}
+	}), nil
 }
 
 func (s *HTTPServer) wrapHandler(handler func(w http.ResponseWriter, req *http.Request) (statusCode int, err error)) http.Handler {
@@ -174,38 +219,99 @@ func (s *HTTPServer) wrapHandler(handler func(w http.ResponseWriter, req *http.R
 }
 
 func (s *HTTPServer) handleDNSQuery(w http.ResponseWriter, req *http.Request) (statusCode int, err error) {
-	if req.Header.Get("Content-Type") != dnsMessageMediaType || req.Header.Get("Accept") != dnsMessageMediaType {
-		return http.StatusBadRequest, errors.New("http: unexpected request format")
-	}
-
-	body, err := io.ReadAll(req.Body)
+	dnsReq, jsonAPI, statusCode, err := parseDoHRequest(req)
 	if err != nil {
-		return http.StatusInternalServerError, fmt.Errorf("http: failed to read body: %w", err)
+		return statusCode, fmt.Errorf("http: invalid DNS request: %w", err)
 	}
 
-	var dnsReq dns.Msg
-	if err = dnsReq.Unpack(body); err != nil {
-		return http.StatusBadRequest, fmt.Errorf("http: failed to unpack DNS request: %w", err)
+	mediaType := negotiateDoHMediaType(req.Header.Get("Accept"), jsonAPI)
+	if mediaType == "" {
+		return http.StatusNotAcceptable, errors.New("http: unsupported response format")
 	}
 
-	dnsResp, err := s.resolver.Resolve(withDNSQueryRemoteAddr(req.Context(), req.RemoteAddr), &dnsReq)
+	dnsResp, err := s.resolver.Resolve(withDNSQueryRemoteAddr(req.Context(), req.RemoteAddr), dnsReq)
 	if err != nil {
 		return http.StatusInternalServerError, fmt.Errorf("http: failed to send DNS request: %w", err)
 	}
 
-	dnsRespBytes, err := dnsResp.Pack()
+	var respBytes []byte
+	if mediaType == dnsMessageMediaType {
+		respBytes, err = dnsResp.Pack()
+	} else {
+		respBytes, err = json.Marshal(newDoHJSONMsg(dnsResp))
+	}
 	if err != nil {
 		return http.StatusInternalServerError, fmt.Errorf("http: failed to pack DNS response: %w", err)
 	}
 
-	w.Header().Set("Content-Type", dnsMessageMediaType)
-	w.Header().Set("Content-Length", strconv.Itoa(len(dnsRespBytes)))
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(respBytes)))
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minResponseTTL(dnsResp)))
 	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(dnsRespBytes)
+	_, _ = w.Write(respBytes)
 
 	return http.StatusOK, nil
 }
 
+func parseDoHRequest(req *http.Request) (msg *dns.Msg, jsonAPI bool, statusCode int, err error) {
+	query := req.URL.Query()
+
+	var body []byte
+	switch {
+	case req.Method == http.MethodPost:
+		if req.Header.Get("Content-Type") != dnsMessageMediaType {
+			return nil, false, http.StatusUnsupportedMediaType, errors.New("unexpected content type")
+		}
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, false, http.StatusInternalServerError, fmt.Errorf("failed to read body: %w", err)
+		}
+	case query.Has("dns"):
+		// RFC 8484 requires base64url without padding, but some clients still send it
+		if body, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(query.Get("dns"), "=")); err != nil {
+			return nil, false, http.StatusBadRequest, fmt.Errorf("failed to decode 'dns' param: %w", err)
+		}
+	case query.Has("name"):
+		if msg, err = parseDoHJSONRequest(query); err != nil {
+			return nil, true, http.StatusBadRequest, err
+		}
+		return msg, true, http.StatusOK, nil
+	default:
+		return nil, false, http.StatusBadRequest, errors.New("either 'dns' or 'name' param is required")
+	}
+
+	msg = &dns.Msg{}
+	if err = msg.Unpack(body); err != nil {
+		return nil, false, http.StatusBadRequest, fmt.Errorf("failed to unpack DNS request: %w", err)
+	}
+	return msg, false, http.StatusOK, nil
+}
+
+// negotiateDoHMediaType returns response media type accepted by the client,
+// JSON API requests are answered in JSON unless the client explicitly asks for DNS wire format.
+func negotiateDoHMediaType(accept string, jsonAPI bool) string {
+	preferred, alternative := dnsMessageMediaType, dnsJSONMediaType
+	if jsonAPI {
+		preferred, alternative = alternative, preferred
+	}
+	if strings.TrimSpace(accept) == "" {
+		return preferred
+	}
+	accepted := map[string]bool{}
+	for _, mediaType := range strings.Split(accept, ",") {
+		mediaType, _, _ = strings.Cut(mediaType, ";")
+		accepted[strings.ToLower(strings.TrimSpace(mediaType))] = true
+	}
+	switch {
+	case accepted[preferred] || accepted["*/*"] || accepted["application/*"]:
+		return preferred
+	case accepted[alternative]:
+		return alternative
+	case accepted[jsonMediaType]:
+		return dnsJSONMediaType
+	}
+	return ""
+}
+
 func (s *HTTPServer) handleRoutes(w http.ResponseWriter, req *http.Request) {
 	routes := s.ipRoutes.Routes()
 	slices.SortFunc(routes, func(a, b IPRouteDNS) int {
@@ -221,12 +327,93 @@ func (s *HTTPServer) handleRoutes(w http.ResponseWriter, req *http.Request) {
 	_ = json.NewEncoder(w).Encode(routes) //nolint:errchkjson // ignore any error
 }
 
-type requestFilterFactory[T any] func(r *http.Request, q url.Values) FilterFunc[T]
+func (s *HTTPServer) handleUpstreams(w http.ResponseWriter, req *http.Request) {
+	res := make([]UpstreamHealth, 0, len(s.upstreams))
+	for _, upstream := range s.upstreams {
+		res = append(res, upstream.Health())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res) //nolint:errchkjson // ignore any error
+}
+
+func (s *HTTPServer) handleDNSCache(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	count := 100
+	if query.Has("count") {
+		count, _ = strconv.Atoi(query.Get("count"))
+		count = max(1, count)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.dnsCache.Entries(strings.TrimSpace(query.Get("search")), count)) //nolint:errchkjson // ignore any error
+}
+
+// handleDNSCacheFlush removes cache entries of a `name`, of a `suffix` with subdomains, or all entries with `all=1`,
+// the whole cache is never flushed implicitly, so that a mistyped param doesn't wipe it.
+func (s *HTTPServer) handleDNSCacheFlush(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	for param := range query {
+		if param != "name" && param != "suffix" && param != "all" {
+			http.Error(w, fmt.Sprintf("unknown param '%s'", param), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(query) != 1 {
+		http.Error(w, "exactly one of 'name', 'suffix' or 'all' params is required", http.StatusBadRequest)
+		return
+	}
+
+	name, err := normalizeDomain(strings.TrimSpace(query.Get("name")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	suffix, err := normalizeDomain(strings.Trim(strings.TrimSpace(query.Get("suffix")), "."))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var removed int
+	switch {
+	case query.Has("name") && name != "":
+		removed = s.dnsCache.FlushName(name)
+	case query.Has("suffix") && suffix != "":
+		removed = s.dnsCache.FlushSuffix(suffix)
+	case query.Has("all") && query.Get("all") == "1":
+		removed = s.dnsCache.Flush()
+	default:
+		http.Error(w, "'name' and 'suffix' params must not be empty, 'all' param must be 1", http.StatusBadRequest)
+		return
+	}
+	s.logger.Info("DNS cache flushed", "name", query.Get("name"), "suffix", query.Get("suffix"), "removed", removed)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"removed": removed}) //nolint:errchkjson // ignore any error
+}
+
+type requestFilterFactory[T any] func(r *http.Request, q url.Values) (FilterFunc[T], error)
+
+// filterExpr compiles filter expression passed in `filter` query param.
+func filterExpr[T any](query url.Values, fields filter.Fields[T], normalizers filter.Normalizers) (FilterFunc[T], error) {
+	expr, err := filter.Compile(query.Get("filter"), fields, normalizers)
+	if err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
 
 func createListHandler[T any](st *stream.Buffered[T], filterFactory requestFilterFactory[T]) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		query := req.URL.Query()
-		filter := filterFactory(req, query)
+		filter, err := filterFactory(req, query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		after, before, err := timeRangeCursors(query, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		backward := queryParamSet(query, "backward")
 
@@ -259,9 +446,9 @@ func createListHandler[T any](st *stream.Buffered[T], filterFactory requestFilte
 		// backward    back      reverse
 
 		if backward == afterMode {
-			res.QueryResult = st.QueryBackward(cursor, count, filter)
+			res.QueryResult = st.QueryRange(after, min(cursor, before), true, count, filter)
 		} else {
-			res.QueryResult = st.Query(cursor, count, filter)
+			res.QueryResult = st.QueryRange(max(cursor, after), before, false, count, filter)
 		}
 		if !afterMode {
 			res.Reverse()
@@ -279,87 +466,62 @@ func createListHandler[T any](st *stream.Buffered[T], filterFactory requestFilte
 	})
 }
 
-func createStreamHandler[T any](st *stream.Buffered[T], logger *slog.Logger, filterFactory requestFilterFactory[T]) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		query := req.URL.Query()
-		filter := filterFactory(req, query)
-
-		conn, err := websocket.Accept(w, req, &websocket.AcceptOptions{OriginPatterns: []string{"*"}})
+// timeRangeCursors converts `since` and `until` query params to the exclusive cursor range.
+func timeRangeCursors(query url.Values, now time.Time) (after, before stream.Cursor, err error) {
+	after, before = 0, math.MaxUint64
+	if query.Has("since") {
+		since, err := parseTimeParam(query.Get("since"), now)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logger.Error("failed to accept websocket connection", "err", err)
-			return
+			return 0, 0, fmt.Errorf("invalid since: %w", err)
 		}
-		defer func() { _ = conn.CloseNow() }()
-
-		logger.Debug("accept websocket connection", "client", req.RemoteAddr)
-		ctx := conn.CloseRead(req.Context())
-
-		cursor := st.QueryBackward(math.MaxUint64, 1, nil).FirstCursor // get last cursor from stream
+		after = max(stream.CursorAt(since), 1) - 1
+	}
+	if query.Has("until") {
+		until, err := parseTimeParam(query.Get("until"), now)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid until: %w", err)
+		}
+		before = stream.CursorAt(until)
+	}
+	return after, before, nil
+}
 
-		updateCh := make(chan struct{})
-		debouncedUpdateCh := debounceUpdateChannel(ctx, time.Second/2, time.Second*2, updateCh)
+// parseTimeParam parses time in RFC 3339 format or as a duration relative to now, e.g. `15m` or `-1h30m`.
+func parseTimeParam(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(strings.TrimPrefix(value, "-"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%s' is neither RFC 3339 time nor duration", value)
+	}
+	return now.Add(-d), nil
+}
 
-		stopListen := st.Listen(func(stream.Cursor, T) {
-			select {
-			case <-ctx.Done():
-			case updateCh <- struct{}{}: // signal about update
-			default: // do not block
-			}
-		})
-		defer stopListen()
-
-		for {
-			select {
-			case <-ctx.Done():
-				logger.Debug("websocket connection closed", "err", ctx.Err())
-				return
-			case <-debouncedUpdateCh:
-				res := st.Query(cursor, 1000, filter)
-				if len(res.Items) > 0 {
-					if err := wsjson.Write(ctx, conn, res.Items); err != nil {
-						logger.Error("failed to send data", "err", err, "cursor", cursor)
-					} else {
-						cursor = res.LastCursor
-					}
-				}
+func allOf[T any](filters ...FilterFunc[T]) FilterFunc[T] {
+	filters = slices.DeleteFunc(filters, func(filter FilterFunc[T]) bool { return filter == nil })
+	if len(filters) == 0 {
+		return nil
+	}
+	return func(val T) bool {
+		for _, filter := range filters {
+			if !filter(val) {
+				return false
 			}
 		}
-	})
+		return true
+	}
 }
 
-func debounceUpdateChannel(ctx context.Context, minInterval, maxInterval time.Duration, ch <-chan struct{}) <-chan struct{} {
-	out := make(chan struct{})
-	go func() {
-		var minTimer, maxTimer <-chan time.Time
-		sendUpdate := func() {
-			minTimer = nil
-			maxTimer = nil
-			select {
-			case <-ctx.Done():
-			case out <- struct{}{}:
-			}
+// queryParamList returns upper-cased values of comma separated list param.
+func queryParamList(q url.Values, name string) []string {
+	var res []string
+	for _, v := range strings.Split(q.Get(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, strings.ToUpper(v))
 		}
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case _, ok := <-ch:
-				if !ok {
-					return
-				}
-				minTimer = time.After(minInterval)
-				if maxTimer == nil {
-					maxTimer = time.After(maxInterval)
-				}
-			case <-minTimer:
-				sendUpdate()
-			case <-maxTimer:
-				sendUpdate()
-			}
-		}
-	}()
-	return out
+	}
+	return res
 }
 
 func queryParamSet(q url.Values, name string) bool {
@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+
+	"github.com/mikhailv/keenetic-dns/internal/stream"
+)
+
+const eventStreamMediaType = "text/event-stream"
+
+// streamGapMessage is sent to a stream client resuming from a cursor followed by evicted entries,
+// entries between the cursor and the oldest available one were evicted.
+type streamGapMessage struct {
+	Type   string        `json:"type"`
+	After  stream.Cursor `json:"after"`
+	Oldest stream.Cursor `json:"oldest"`
+}
+
+func createStreamHandler[T any](st *stream.Buffered[T], logger *slog.Logger, filterFactory requestFilterFactory[T]) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		filter, err := filterFactory(req, query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cursor, gap, err := streamStartCursor(st, query.Get("after"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		conn, err := websocket.Accept(w, req, &websocket.AcceptOptions{OriginPatterns: []string{"*"}})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			logger.Error("failed to accept websocket connection", "err", err)
+			return
+		}
+		defer func() { _ = conn.CloseNow() }()
+
+		logger.Debug("accept websocket connection", "client", req.RemoteAddr)
+		ctx := conn.CloseRead(req.Context())
+
+		if gap != nil {
+			if err := wsjson.Write(ctx, conn, gap); err != nil {
+				logger.Error("failed to send gap", "err", err, "cursor", cursor)
+				return
+			}
+		}
+
+		err = streamUpdates(ctx, st, clientHost(req.RemoteAddr), cursor, filter, func(res stream.QueryResult[T]) error {
+			return wsjson.Write(ctx, conn, res.Items)
+		})
+		if err != nil {
+			logger.Error("failed to send data", "err", err)
+			return
+		}
+		logger.Debug("websocket connection closed", "err", ctx.Err())
+	})
+}
+
+// createSSEHandler creates handler streaming entries as server-sent events, every event carries a batch of entries
+// and its id is the cursor of the last one, so that the standard `Last-Event-ID` header resumes the stream.
+func createSSEHandler[T any](ctx context.Context, st *stream.Buffered[T], logger *slog.Logger, filterFactory requestFilterFactory[T]) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		filter, err := filterFactory(req, query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// http server waits for active requests on shutdown, so close the stream as soon as shutdown starts
+		reqCtx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		defer context.AfterFunc(ctx, cancel)()
+
+		var cursor stream.Cursor
+		var gap *streamGapMessage
+		if lastEventID := req.Header.Get("Last-Event-ID"); lastEventID != "" {
+			// the header is set by a browser or a proxy on reconnect, so instead of failing the stream which would be
+			// reconnected with the same header again, continue with live updates
+			cursor, gap, err = streamStartCursor(st, lastEventID)
+			if err != nil {
+				logger.Warn("ignore malformed Last-Event-ID", "err", err, "client", req.RemoteAddr)
+				cursor, gap, _ = streamStartCursor(st, "")
+			}
+		} else {
+			cursor, gap, err = streamStartCursor(st, query.Get("after"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", eventStreamMediaType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			logger.Error("failed to flush response", "err", err)
+			return
+		}
+
+		logger.Debug("accept event stream connection", "client", req.RemoteAddr)
+
+		if gap != nil {
+			if err := writeSSEEvent(w, rc, "gap", "", gap); err != nil {
+				logger.Error("failed to send gap", "err", err, "cursor", cursor)
+				return
+			}
+		}
+
+		err = streamUpdates(reqCtx, st, clientHost(req.RemoteAddr), cursor, filter, func(res stream.QueryResult[T]) error {
+			return writeSSEEvent(w, rc, "", res.LastCursor.String(), res.Items)
+		})
+		if err != nil && reqCtx.Err() == nil {
+			logger.Error("failed to send data", "err", err)
+			return
+		}
+		logger.Debug("event stream connection closed", "err", reqCtx.Err())
+	})
+}
+
+func writeSSEEvent(w http.ResponseWriter, rc *http.ResponseController, event, id string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if event != "" {
+		_, _ = fmt.Fprintf(&buf, "event: %s\n", event)
+	}
+	if id != "" {
+		_, _ = fmt.Fprintf(&buf, "id: %s\n", id)
+	}
+	_, _ = fmt.Fprintf(&buf, "data: %s\n\n", payload)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// streamStartCursor returns the cursor to stream from: the one a client resumes from, or the latest one.
+// Gap is returned when entries following the client cursor were evicted from the stream.
+func streamStartCursor[T any](st *stream.Buffered[T], resumeFrom string) (stream.Cursor, *streamGapMessage, error) {
+	if resumeFrom == "" {
+		return st.QueryBackward(math.MaxUint64, 1, nil).FirstCursor, nil, nil // get last cursor from stream
+	}
+	cursor, err := stream.ParseCursor(resumeFrom)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid cursor '%s': %w", resumeFrom, err)
+	}
+	if evicted, ok := st.Evicted(); ok && cursor < evicted {
+		oldest, _ := st.Oldest()
+		return cursor, &streamGapMessage{"gap", cursor, oldest}, nil
+	}
+	return cursor, nil, nil
+}
+
+// streamUpdates sends entries appended after the cursor in batches, the backlog first and then live updates,
+// until the context is done or sending fails. The client is used to account notifications dropped for it.
+func streamUpdates[T any](ctx context.Context, st *stream.Buffered[T], client string, cursor stream.Cursor, filter FilterFunc[T], send func(res stream.QueryResult[T]) error) error {
+	updateCh := make(chan struct{})
+	debouncedUpdateCh := debounceUpdateChannel(ctx, time.Second/2, time.Second*2, updateCh)
+
+	stopListen := st.Listen(client, func(stream.Cursor, T) {
+		select {
+		case <-ctx.Done():
+		case updateCh <- struct{}{}: // signal about update
+		default: // do not block
+		}
+	})
+	defer stopListen()
+
+	sendUpdates := func() error {
+		for {
+			res := st.Query(cursor, 1000, filter)
+			if len(res.Items) > 0 {
+				if err := send(res); err != nil {
+					return fmt.Errorf("cursor %s: %w", cursor, err)
+				}
+				cursor = res.LastCursor
+			}
+			if !res.HasMore {
+				return nil
+			}
+		}
+	}
+
+	if err := sendUpdates(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-debouncedUpdateCh:
+			if err := sendUpdates(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func debounceUpdateChannel(ctx context.Context, minInterval, maxInterval time.Duration, ch <-chan struct{}) <-chan struct{} {
+	out := make(chan struct{})
+	go func() {
+		var minTimer, maxTimer <-chan time.Time
+		sendUpdate := func() {
+			minTimer = nil
+			maxTimer = nil
+			select {
+			case <-ctx.Done():
+			case out <- struct{}{}:
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-ch:
+				if !ok {
+					return
+				}
+				minTimer = time.After(minInterval)
+				if maxTimer == nil {
+					maxTimer = time.After(maxInterval)
+				}
+			case <-minTimer:
+				sendUpdate()
+			case <-maxTimer:
+				sendUpdate()
+			}
+		}
+	}()
+	return out
+}
@@ -31,6 +31,7 @@ func (s *DNSStore) fill(records []DNSRecord) {
 	clear(s.byDomain)
 	clear(s.byIP)
 	for _, rec := range records {
+		rec.Domain = normalizeName(rec.Domain) // dumps of older versions may contain names in original case
 		s.add(rec)
 	}
 }
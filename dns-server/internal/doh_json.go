@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// dohJSONMsg is DNS message in JSON format used by Google and Cloudflare DoH JSON API.
+type dohJSONMsg struct {
+	Status    int               `json:"Status"`
+	TC        bool              `json:"TC"`
+	RD        bool              `json:"RD"`
+	RA        bool              `json:"RA"`
+	AD        bool              `json:"AD"`
+	CD        bool              `json:"CD"`
+	Question  []dohJSONQuestion `json:"Question"`
+	Answer    []dohJSONRR       `json:"Answer,omitempty"`
+	Authority []dohJSONRR       `json:"Authority,omitempty"`
+}
+
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type dohJSONRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+func parseDoHJSONRequest(query url.Values) (*dns.Msg, error) {
+	name, err := normalizeDomain(strings.TrimSpace(query.Get("name")))
+	if err != nil {
+		return nil, err
+	}
+	if name == "" || len(name) > 253 {
+		return nil, fmt.Errorf("invalid name '%s'", query.Get("name"))
+	}
+
+	qtype := dns.TypeA
+	if s := strings.TrimSpace(query.Get("type")); s != "" {
+		if n, err := strconv.ParseUint(s, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if t, ok := dns.StringToType[strings.ToUpper(s)]; ok {
+			qtype = t
+		} else {
+			return nil, fmt.Errorf("invalid type '%s'", s)
+		}
+	}
+
+	msg := &dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.CheckingDisabled = queryParamSet(query, "cd")
+	if queryParamSet(query, "do") {
+		msg.SetEdns0(dnsUDPBufferSize, true)
+	}
+	return msg, nil
+}
+
+func newDoHJSONMsg(msg *dns.Msg) dohJSONMsg {
+	res := dohJSONMsg{
+		Status:    msg.Rcode,
+		TC:        msg.Truncated,
+		RD:        msg.RecursionDesired,
+		RA:        msg.RecursionAvailable,
+		AD:        msg.AuthenticatedData,
+		CD:        msg.CheckingDisabled,
+		Question:  make([]dohJSONQuestion, 0, len(msg.Question)),
+		Answer:    newDoHJSONRRs(msg.Answer),
+		Authority: newDoHJSONRRs(msg.Ns),
+	}
+	for _, q := range msg.Question {
+		res.Question = append(res.Question, dohJSONQuestion{q.Name, q.Qtype})
+	}
+	return res
+}
+
+func newDoHJSONRRs(rrs []dns.RR) []dohJSONRR {
+	if len(rrs) == 0 {
+		return nil
+	}
+	res := make([]dohJSONRR, 0, len(rrs))
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		res = append(res, dohJSONRR{
+			Name: hdr.Name,
+			Type: hdr.Rrtype,
+			TTL:  hdr.Ttl,
+			Data: rrData(rr),
+		})
+	}
+	return res
+}
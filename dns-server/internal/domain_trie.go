@@ -0,0 +1,312 @@
+package internal
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"iter"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// HostConflict describes a host pattern listed for several interfaces, the chosen one is used for routing.
+type HostConflict struct {
+	Pattern string   `json:"pattern"`
+	Ifaces  []string `json:"ifaces"`
+	Chosen  string   `json:"chosen"`
+}
+
+// hostPattern is a parsed routing host pattern, one of:
+//
+//	example.com      the domain and its subdomains
+//	=example.com     the domain only
+//	*.example.com    `*` label matches any single label
+//	/^ex.*\.com$/    regular expression matched against the whole lowercase name
+//	!pattern         exclusion, names matching the pattern are never routed to the interface
+//
+// Geosite keywords are keyword patterns matching a substring of the name, they have no text form in config.
+type hostPattern struct {
+	text    string // canonical form
+	labels  []string
+	regex   *regexp.Regexp
+	keyword string
+	exact   bool
+	exclude bool
+}
+
+func newKeywordHostPattern(keyword string) hostPattern {
+	keyword = strings.ToLower(keyword)
+	return hostPattern{text: "keyword:" + keyword, keyword: keyword}
+}
+
+// excluded returns the exclusion of the pattern.
+func (p hostPattern) excluded() hostPattern {
+	if !p.exclude {
+		p.exclude = true
+		p.text = "!" + p.text
+	}
+	return p
+}
+
+func parseHostPattern(s string) (hostPattern, error) {
+	p := hostPattern{}
+	s = strings.TrimSpace(s)
+	s, p.exclude = strings.CutPrefix(s, "!")
+
+	if len(s) >= 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return p, fmt.Errorf("invalid regular expression: %w", err)
+		}
+		p.regex = re
+		p.text = s
+	} else {
+		s, p.exact = strings.CutPrefix(s, "=")
+		s, err := normalizeDomain(strings.Trim(s, "."))
+		if err != nil {
+			return p, err
+		}
+		if s == "" {
+			return p, errors.New("empty domain")
+		}
+		p.labels = strings.Split(s, ".")
+		for _, label := range p.labels {
+			if err := validateHostLabel(label); err != nil {
+				return p, err
+			}
+		}
+		p.text = s
+		if p.exact {
+			p.text = "=" + p.text
+		}
+	}
+	if p.exclude {
+		p.text = "!" + p.text
+	}
+	return p, nil
+}
+
+func validateHostLabel(label string) error {
+	if label == "" {
+		return errors.New("empty label")
+	}
+	if label == "*" {
+		return nil
+	}
+	if len(label) > 63 {
+		return fmt.Errorf("label '%s' is longer than 63 characters", label)
+	}
+	for _, c := range label {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		case c == '*':
+			return fmt.Errorf("wildcard must be a whole label, got '%s'", label)
+		default:
+			return fmt.Errorf("invalid character '%c' in label '%s'", c, label)
+		}
+	}
+	return nil
+}
+
+// domainTrie indexes host patterns by reversed domain labels, so that lookup is a walk over the name labels.
+// The most specific matching pattern wins and ties are resolved by interface priority. Exclusions override
+// any pattern of their interface, regular expressions and keywords are the least specific patterns (see domainTrieMatch).
+type domainTrie struct {
+	root      domainTrieNode
+	scanned   []domainTrieEntry // patterns which can't be indexed by labels, they are matched against each name
+	priority  []string
+	conflicts []HostConflict
+}
+
+type domainTrieNode struct {
+	children map[string]*domainTrieNode
+	entries  []domainTrieEntry
+}
+
+type domainTrieEntry struct {
+	iface   string
+	exact   bool
+	exclude bool
+	regex   *regexp.Regexp
+	keyword string
+}
+
+func (e domainTrieEntry) indexed() bool {
+	return e.regex == nil && e.keyword == ""
+}
+
+// matchName matches not indexed entry against the name without trailing dot.
+func (e domainTrieEntry) matchName(name string) bool {
+	if e.regex != nil {
+		return e.regex.MatchString(name)
+	}
+	return strings.Contains(name, e.keyword)
+}
+
+// newDomainTrie builds trie of host patterns by interface.
+// Interfaces are preferred in the priority list order, interfaces missing in the list follow in alphabetical order.
+func newDomainTrie(hosts map[string][]hostPattern, priority []string) *domainTrie {
+	t := &domainTrie{priority: priority}
+	patternIfaces := map[string][]string{}
+	for iface, patterns := range hosts {
+		for _, pattern := range patterns {
+			t.insert(pattern, iface)
+			if !pattern.exclude && !slices.Contains(patternIfaces[pattern.text], iface) {
+				patternIfaces[pattern.text] = append(patternIfaces[pattern.text], iface)
+			}
+		}
+	}
+
+	for pattern, ifaces := range patternIfaces {
+		if len(ifaces) > 1 {
+			slices.SortFunc(ifaces, t.compareIfaces)
+			t.conflicts = append(t.conflicts, HostConflict{pattern, ifaces, ifaces[0]})
+		}
+	}
+	slices.SortFunc(t.conflicts, func(a, b HostConflict) int {
+		return cmp.Compare(a.Pattern, b.Pattern)
+	})
+	return t
+}
+
+func (t *domainTrie) compareIfaces(a, b string) int {
+	rank := func(iface string) int {
+		if i := slices.Index(t.priority, iface); i >= 0 {
+			return i
+		}
+		return len(t.priority)
+	}
+	return cmp.Or(cmp.Compare(rank(a), rank(b)), cmp.Compare(a, b))
+}
+
+func (t *domainTrie) insert(pattern hostPattern, iface string) {
+	entry := domainTrieEntry{iface: iface, exact: pattern.exact, exclude: pattern.exclude, regex: pattern.regex, keyword: pattern.keyword}
+	if !entry.indexed() {
+		t.scanned = append(t.scanned, entry)
+		return
+	}
+	node := &t.root
+	for _, label := range slices.Backward(pattern.labels) {
+		child := node.children[label]
+		if child == nil {
+			if node.children == nil {
+				node.children = map[string]*domainTrieNode{}
+			}
+			child = &domainTrieNode{}
+			node.children[label] = child
+		}
+		node = child
+	}
+	node.entries = append(node.entries, entry)
+}
+
+// domainTrieMatch is a pattern matching the looked up name. Patterns are ranked by specificity: a pattern with
+// more labels wins, then the one with fewer `*` labels, then the domain only pattern wins over the one with subdomains.
+// Regular expressions and keywords are less specific than any other pattern.
+type domainTrieMatch struct {
+	domainTrieEntry
+	depth     int
+	wildcards int
+}
+
+func (m domainTrieMatch) compareSpecificity(other domainTrieMatch) int {
+	return cmp.Or(
+		compareBool(m.indexed(), other.indexed()),
+		cmp.Compare(m.depth, other.depth),
+		cmp.Compare(other.wildcards, m.wildcards),
+		compareBool(m.exact, other.exact),
+	)
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// Lookup returns interface of the most specific pattern matching the name, the name must be normalized.
+func (t *domainTrie) Lookup(name string) (iface string) {
+	var matches []domainTrieMatch
+	var excluded []string
+	visit := func(m domainTrieMatch) {
+		if m.exclude {
+			excluded = append(excluded, m.iface)
+		} else {
+			matches = append(matches, m)
+		}
+	}
+
+	t.match(&t.root, slices.Collect(reversedLabels(name)), domainTrieMatch{}, visit)
+	if len(t.scanned) > 0 {
+		name = strings.Trim(name, ".")
+		for _, entry := range t.scanned {
+			if entry.matchName(name) {
+				visit(domainTrieMatch{domainTrieEntry: entry})
+			}
+		}
+	}
+
+	var best *domainTrieMatch
+	for i, m := range matches {
+		if slices.Contains(excluded, m.iface) {
+			continue
+		}
+		if best == nil || cmp.Or(m.compareSpecificity(*best), t.compareIfaces(best.iface, m.iface)) > 0 {
+			best = &matches[i]
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.iface
+}
+
+// match visits entries of the node and its descendants matching the rest of the name labels,
+// the path tracks depth and wildcards of the node.
+func (t *domainTrie) match(node *domainTrieNode, labels []string, path domainTrieMatch, visit func(m domainTrieMatch)) {
+	for _, entry := range node.entries {
+		if !entry.exact || len(labels) == 0 {
+			path.domainTrieEntry = entry
+			visit(path)
+		}
+	}
+	if len(labels) == 0 {
+		return
+	}
+	path.depth++
+	if child := node.children[labels[0]]; child != nil {
+		t.match(child, labels[1:], path, visit)
+	}
+	if child := node.children["*"]; child != nil && labels[0] != "*" {
+		path.wildcards++
+		t.match(child, labels[1:], path, visit)
+	}
+}
+
+func (t *domainTrie) Conflicts() []HostConflict {
+	return t.conflicts
+}
+
+// reversedLabels iterates over domain name labels starting from the top-level one.
+func reversedLabels(name string) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		rest := strings.Trim(name, ".")
+		for rest != "" {
+			label := rest
+			if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+				label, rest = rest[i+1:], rest[:i]
+			} else {
+				rest = ""
+			}
+			if !yield(label) {
+				return
+			}
+		}
+	}
+}
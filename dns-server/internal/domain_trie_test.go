@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		text    string
+		exact   bool
+		exclude bool
+		regex   bool
+		err     string
+	}{
+		{pattern: "example.com", text: "example.com"},
+		{pattern: " Example.COM. ", text: "example.com"},
+		{pattern: ".example.com", text: "example.com"},
+		{pattern: "=example.com", text: "=example.com", exact: true},
+		{pattern: "!example.com", text: "!example.com", exclude: true},
+		{pattern: "!=example.com", text: "!=example.com", exact: true, exclude: true},
+		{pattern: "*.example.com", text: "*.example.com"},
+		{pattern: "a.*.example.com", text: "a.*.example.com"},
+		{pattern: "_dmarc.example.com", text: "_dmarc.example.com"},
+		{pattern: "пример.рф", text: "xn--e1afmkfd.xn--p1ai"},
+		{pattern: "=*.Пример.РФ", text: "=*.xn--e1afmkfd.xn--p1ai", exact: true},
+		{pattern: "xn--e1afmkfd.xn--p1ai", text: "xn--e1afmkfd.xn--p1ai"},
+		{pattern: "/^ex.*\\.com$/", text: "/^ex.*\\.com$/", regex: true},
+		{pattern: "!/^ads\\./", text: "!/^ads\\./", exclude: true, regex: true},
+
+		{pattern: "", err: "empty domain"},
+		{pattern: "=", err: "empty domain"},
+		{pattern: "!", err: "empty domain"},
+		{pattern: "a..example.com", err: "empty label"},
+		{pattern: "ex*.com", err: "wildcard must be a whole label, got 'ex*'"},
+		{pattern: "exa mple.com", err: "invalid character ' ' in label 'exa mple'"},
+		{pattern: strings.Repeat("a", 64) + ".com", err: "is longer than 63 characters"},
+		{pattern: "/(/", err: "invalid regular expression"},
+		{pattern: "при мер.рф", err: "invalid domain 'при мер.рф'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			p, err := parseHostPattern(tt.pattern)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error '%v', want '%s'", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if p.text != tt.text || p.exact != tt.exact || p.exclude != tt.exclude || (p.regex != nil) != tt.regex {
+				t.Errorf("got text '%s', exact %v, exclude %v, regex %v; want '%s', %v, %v, %v",
+					p.text, p.exact, p.exclude, p.regex != nil, tt.text, tt.exact, tt.exclude, tt.regex)
+			}
+		})
+	}
+}
+
+func TestDomainTrieLookup(t *testing.T) {
+	tests := []struct {
+		name     string
+		hosts    map[string]Hosts
+		priority []string
+		lookups  map[string]string // name -> expected interface
+	}{
+		{
+			name:  "domain with subdomains",
+			hosts: map[string]Hosts{"wg0": {"example.com"}},
+			lookups: map[string]string{
+				"example.com":     "wg0",
+				"a.b.example.com": "wg0",
+				"com":             "",
+				"notexample.com":  "",
+				"example.com.au":  "",
+				"www.example.org": "",
+			},
+		},
+		{
+			name:  "domain only",
+			hosts: map[string]Hosts{"wg0": {"=example.com"}},
+			lookups: map[string]string{
+				"example.com":     "wg0",
+				"www.example.com": "",
+			},
+		},
+		{
+			name:  "wildcard matches single label",
+			hosts: map[string]Hosts{"wg0": {"*.example.com"}},
+			lookups: map[string]string{
+				"example.com":       "",
+				"www.example.com":   "wg0",
+				"a.www.example.com": "wg0",
+			},
+		},
+		{
+			name:  "more labels win",
+			hosts: map[string]Hosts{"wg0": {"example.com"}, "eth0": {"video.example.com"}},
+			lookups: map[string]string{
+				"www.example.com":     "wg0",
+				"video.example.com":   "eth0",
+				"a.video.example.com": "eth0",
+			},
+		},
+		{
+			name:     "literal wins over wildcard",
+			hosts:    map[string]Hosts{"wg0": {"*.example.com"}, "eth0": {"www.example.com"}},
+			priority: []string{"wg0", "eth0"},
+			lookups: map[string]string{
+				"www.example.com":   "eth0",
+				"a.www.example.com": "eth0",
+				"api.example.com":   "wg0",
+			},
+		},
+		{
+			name:     "fewer wildcards win",
+			hosts:    map[string]Hosts{"wg0": {"*.*.example.com"}, "eth0": {"*.cdn.example.com"}},
+			priority: []string{"wg0", "eth0"},
+			lookups: map[string]string{
+				"a.cdn.example.com": "eth0",
+				"a.img.example.com": "wg0",
+			},
+		},
+		{
+			name:     "exact wins over suffix",
+			hosts:    map[string]Hosts{"wg0": {"example.com"}, "eth0": {"=example.com"}},
+			priority: []string{"wg0", "eth0"},
+			lookups: map[string]string{
+				"example.com":     "eth0",
+				"www.example.com": "wg0",
+			},
+		},
+		{
+			name:     "priority resolves equally specific patterns",
+			hosts:    map[string]Hosts{"wg0": {"example.com"}, "eth0": {"example.com"}, "ppp0": {"example.com"}},
+			priority: []string{"ppp0"},
+			lookups:  map[string]string{"example.com": "ppp0"},
+		},
+		{
+			name:    "alphabetical order resolves interfaces missing in priority",
+			hosts:   map[string]Hosts{"wg0": {"example.com"}, "eth0": {"example.com"}},
+			lookups: map[string]string{"example.com": "eth0"},
+		},
+		{
+			name:     "priority doesn't override specificity",
+			hosts:    map[string]Hosts{"wg0": {"example.com"}, "eth0": {"www.example.com"}},
+			priority: []string{"wg0", "eth0"},
+			lookups:  map[string]string{"www.example.com": "eth0"},
+		},
+		{
+			name:  "exclusion overrides matches of its interface",
+			hosts: map[string]Hosts{"wg0": {"example.com", "=www.example.com", "!ads.example.com"}},
+			lookups: map[string]string{
+				"www.example.com":   "wg0",
+				"ads.example.com":   "",
+				"x.ads.example.com": "",
+			},
+		},
+		{
+			name:     "exclusion overrides more specific match of its interface",
+			hosts:    map[string]Hosts{"wg0": {"=www.example.com", "!example.com"}},
+			priority: []string{"wg0"},
+			lookups:  map[string]string{"www.example.com": ""},
+		},
+		{
+			name:     "exclusion doesn't affect other interfaces",
+			hosts:    map[string]Hosts{"wg0": {"www.example.com", "!ads.example.com"}, "eth0": {"example.com"}},
+			priority: []string{"wg0", "eth0"},
+			lookups: map[string]string{
+				"www.example.com": "wg0",
+				"ads.example.com": "eth0",
+			},
+		},
+		{
+			name:  "regex",
+			hosts: map[string]Hosts{"wg0": {"/^(www|api)\\.example\\.com$/"}},
+			lookups: map[string]string{
+				"www.example.com": "wg0",
+				"cdn.example.com": "",
+			},
+		},
+		{
+			name:     "regex loses to any trie match",
+			hosts:    map[string]Hosts{"wg0": {"/^www\\.example\\.com$/"}, "eth0": {"com"}},
+			priority: []string{"wg0", "eth0"},
+			lookups: map[string]string{
+				"www.example.com": "eth0",
+				"www.example.org": "",
+			},
+		},
+		{
+			name:     "regex exclusion",
+			hosts:    map[string]Hosts{"wg0": {"example.com", "!/^ads\\./"}},
+			priority: []string{"wg0"},
+			lookups: map[string]string{
+				"www.example.com": "wg0",
+				"ads.example.com": "",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trie := newDomainTrie(parseTestHosts(t, tt.hosts), tt.priority)
+			for name, want := range tt.lookups {
+				if got := trie.Lookup(name); got != want {
+					t.Errorf("Lookup(%s) = '%s', want '%s'", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDomainTrieKeyword(t *testing.T) {
+	hosts := parseTestHosts(t, map[string]Hosts{"eth0": {"video.example.com"}, "ppp0": {"!/^ads\\./"}})
+	hosts["wg0"] = []hostPattern{newKeywordHostPattern("Video")}
+	hosts["ppp0"] = append(hosts["ppp0"], newKeywordHostPattern("ads"))
+	trie := newDomainTrie(hosts, []string{"wg0", "ppp0", "eth0"})
+
+	for name, want := range map[string]string{
+		"youtubevideo.com":    "wg0",
+		"video.example.com":   "eth0", // keyword loses to any trie match
+		"my-ads.example.com":  "ppp0",
+		"ads.video.com":       "wg0", // ppp0 exclusion overrides its keyword
+		"example.com":         "",
+		"video-ads.example.x": "wg0",
+	} {
+		if got := trie.Lookup(name); got != want {
+			t.Errorf("Lookup(%s) = '%s', want '%s'", name, got, want)
+		}
+	}
+}
+
+func TestDomainTrieConflicts(t *testing.T) {
+	trie := newDomainTrie(parseTestHosts(t, map[string]Hosts{
+		"wg0":  {"example.com", "=example.org", "!ads.example.com"},
+		"eth0": {"Example.com.", "example.org", "!ads.example.com"},
+		"ppp0": {"=example.org"},
+	}), []string{"ppp0", "wg0"})
+
+	want := []HostConflict{
+		{Pattern: "=example.org", Ifaces: []string{"ppp0", "wg0"}, Chosen: "ppp0"},
+		{Pattern: "example.com", Ifaces: []string{"wg0", "eth0"}, Chosen: "wg0"},
+	}
+	got := trie.Conflicts()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].Pattern != want[i].Pattern || strings.Join(got[i].Ifaces, ",") != strings.Join(want[i].Ifaces, ",") || got[i].Chosen != want[i].Chosen {
+			t.Errorf("got %v, want %v", got[i], want[i])
+		}
+	}
+}
+
+func parseTestHosts(t *testing.T, hosts map[string]Hosts) map[string][]hostPattern {
+	t.Helper()
+	res := map[string][]hostPattern{}
+	for iface, patterns := range hosts {
+		for _, s := range patterns {
+			pattern, err := parseHostPattern(s)
+			if err != nil {
+				t.Fatalf("invalid pattern '%s': %v", s, err)
+			}
+			res[iface] = append(res[iface], pattern)
+		}
+	}
+	return res
+}
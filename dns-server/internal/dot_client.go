@@ -0,0 +1,280 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mikhailv/keenetic-dns/dns-server/internal/metrics"
+)
+
+const (
+	defaultDoTPort    = "853"
+	defaultDoTTimeout = 10 * time.Second
+	dotIdleTimeout    = 30 * time.Second
+	dotKeepAlive      = 15 * time.Second
+)
+
+var errDoTConnectionClosed = errors.New("dot_client: connection closed")
+
+var _ DNSResolver = (*dotClient)(nil)
+
+// dotClient is a DNS-over-TLS client which keeps a single persistent connection to the server
+// and pipelines concurrent queries over it.
+type dotClient struct {
+	address   string
+	timeout   time.Duration
+	tlsConfig *tls.Config
+	mu        sync.Mutex
+	conn      *dotConn
+}
+
+// NewDoTClient creates DNS-over-TLS client for address in the form `tls://host[:port][?server_name=name]`,
+// if server name is not specified the host is used for certificate verification.
+// Non-positive timeout is replaced with the default one.
+func NewDoTClient(address string, timeout time.Duration) (DNSResolver, error) {
+	if timeout <= 0 {
+		timeout = defaultDoTTimeout
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("dot_client: invalid address '%s': %w", address, err)
+	}
+	host, port := u.Hostname(), u.Port()
+	if host == "" {
+		return nil, fmt.Errorf("dot_client: invalid address '%s': host is empty", address)
+	}
+	if port == "" {
+		port = defaultDoTPort
+	}
+	serverName := u.Query().Get("server_name")
+	if serverName == "" {
+		serverName = host
+	}
+	return &dotClient{
+		address: net.JoinHostPort(host, port),
+		timeout: timeout,
+		tlsConfig: &tls.Config{
+			ServerName: serverName,
+			MinVersion: tls.VersionTLS12,
+		},
+	}, nil
+}
+
+func (c *dotClient) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	defer metrics.TrackDuration("dot_client.resolve")()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := c.connection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := conn.exchange(ctx, msg)
+		if err == nil {
+			return resp, nil
+		}
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return nil, err // cancelled by the caller, the connection is fine
+		}
+		// timed out query means the connection may be half-open, so it's not reused for the next queries
+		c.dropConnection(conn)
+		// server could close an idle connection at any moment, so retry once over a fresh one
+		if ctx.Err() != nil || !reused || attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+// connection returns the current connection or dials a new one, dialing is done without holding the lock,
+// so that a slow handshake doesn't block queries which could be sent over a connection established meanwhile.
+func (c *dotClient) connection(ctx context.Context) (conn *dotConn, reused bool, err error) {
+	if conn := c.currentConnection(); conn != nil {
+		return conn, true, nil
+	}
+
+	dialer := tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: c.timeout, KeepAlive: dotKeepAlive},
+		Config:    c.tlsConfig,
+	}
+	netConn, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		metrics.TrackStatus("dot_client.connect", "failed")
+		return nil, false, fmt.Errorf("dot_client: failed to connect: %w", err)
+	}
+	metrics.TrackStatus("dot_client.connect", "success")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil && !c.conn.isClosed() {
+		// another query has established connection concurrently, prefer it to keep a single one
+		_ = netConn.Close()
+		return c.conn, true, nil
+	}
+	c.conn = newDoTConn(netConn)
+	return c.conn, false, nil
+}
+
+func (c *dotClient) currentConnection() *dotConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil && !c.conn.isClosed() {
+		return c.conn
+	}
+	return nil
+}
+
+func (c *dotClient) dropConnection(conn *dotConn) {
+	conn.close(errDoTConnectionClosed)
+	c.mu.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	c.mu.Unlock()
+}
+
+// dotConn is closed when nothing is read from it for dotIdleTimeout (or until the deadline of a pending query
+// if it's later), so idle and half-open connections don't outlive the server side.
+type dotConn struct {
+	conn         *dns.Conn
+	writeMu      sync.Mutex
+	mu           sync.Mutex
+	pending      map[uint16]chan *dns.Msg
+	nextID       uint16
+	readDeadline time.Time
+	err          error
+}
+
+func newDoTConn(conn net.Conn) *dotConn {
+	c := &dotConn{
+		conn:    &dns.Conn{Conn: conn},
+		pending: map[uint16]chan *dns.Msg{},
+		nextID:  dns.Id(),
+	}
+	c.extendReadDeadline(time.Now().Add(dotIdleTimeout))
+	go c.readLoop()
+	return c
+}
+
+func (c *dotConn) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	id, respCh, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(id)
+
+	req := msg.Copy()
+	req.Id = id // ids of concurrent client queries may collide, so replace them with connection unique ones
+
+	readDeadline := time.Now().Add(dotIdleTimeout)
+	if deadline, ok := ctx.Deadline(); ok && deadline.After(readDeadline) {
+		readDeadline = deadline
+	}
+	c.extendReadDeadline(readDeadline)
+
+	c.writeMu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetWriteDeadline(deadline)
+	}
+	err = c.conn.WriteMsg(req)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, fmt.Errorf("dot_client: failed to send request: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case resp, ok := <-respCh:
+		if !ok {
+			return nil, fmt.Errorf("dot_client: failed to read response: %w", c.closeErr())
+		}
+		resp.Id = msg.Id
+		return resp, nil
+	}
+}
+
+func (c *dotConn) register() (uint16, chan *dns.Msg, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+	for {
+		c.nextID++
+		if _, ok := c.pending[c.nextID]; !ok {
+			break
+		}
+	}
+	ch := make(chan *dns.Msg, 1)
+	c.pending[c.nextID] = ch
+	return c.nextID, ch, nil
+}
+
+func (c *dotConn) unregister(id uint16) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// extendReadDeadline moves read deadline of the connection forward, it's never moved back,
+// so that an earlier deadline of one query doesn't cut off another one.
+func (c *dotConn) extendReadDeadline(deadline time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if deadline.After(c.readDeadline) {
+		c.readDeadline = deadline
+		_ = c.conn.SetReadDeadline(deadline)
+	}
+}
+
+func (c *dotConn) readLoop() {
+	for {
+		msg, err := c.conn.ReadMsg()
+		if err != nil {
+			c.close(err)
+			return
+		}
+		c.extendReadDeadline(time.Now().Add(dotIdleTimeout))
+		c.mu.Lock()
+		if ch, ok := c.pending[msg.Id]; ok {
+			delete(c.pending, msg.Id)
+			ch <- msg
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *dotConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	_ = c.conn.Close()
+}
+
+func (c *dotConn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *dotConn) isClosed() bool {
+	return c.closeErr() != nil
+}
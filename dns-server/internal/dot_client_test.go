@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dotTestHandler serves queries of the n-th accepted connection (starting from 0),
+// it returns false to close the connection.
+type dotTestHandler func(n int, req *dns.Msg) (resp *dns.Msg, ok bool)
+
+func TestDoTClientReconnect(t *testing.T) {
+	answer := func(_ int, req *dns.Msg) (*dns.Msg, bool) {
+		return new(dns.Msg).SetReply(req), true
+	}
+
+	tests := []struct {
+		name    string
+		handler dotTestHandler
+		results []bool // expected success of consecutive queries
+		conns   int32
+	}{
+		{
+			name:    "persistent connection",
+			handler: answer,
+			results: []bool{true, true, true},
+			conns:   1,
+		},
+		{
+			name: "timeout drops connection",
+			handler: func(n int, req *dns.Msg) (*dns.Msg, bool) {
+				if n == 0 {
+					return nil, true // half-open connection, queries are read but never answered
+				}
+				return answer(n, req)
+			},
+			results: []bool{false, true, true},
+			conns:   2,
+		},
+		{
+			name: "connection closed by server is retried",
+			handler: func(n int, req *dns.Msg) (*dns.Msg, bool) {
+				if n == 0 && req.Question[0].Name == "b.example.com." {
+					return nil, false
+				}
+				return answer(n, req)
+			},
+			results: []bool{true, true, true},
+			conns:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, certPool, conns := startDoTTestServer(t, tt.handler)
+			client := newTestDoTClient(t, addr, certPool, 300*time.Millisecond)
+
+			for i, want := range tt.results {
+				req := new(dns.Msg).SetQuestion(string(rune('a'+i))+".example.com.", dns.TypeA)
+				resp, err := client.Resolve(context.Background(), req)
+				if want && (err != nil || resp.Id != req.Id) {
+					t.Fatalf("query %d: unexpected error: %v", i, err)
+				}
+				if !want && err == nil {
+					t.Fatalf("query %d: expected error", i)
+				}
+			}
+			if got := conns.Load(); got != tt.conns {
+				t.Errorf("got %d connections, want %d", got, tt.conns)
+			}
+		})
+	}
+}
+
+func TestDoTClientCancelKeepsConnection(t *testing.T) {
+	release := make(chan struct{})
+	addr, certPool, conns := startDoTTestServer(t, func(_ int, req *dns.Msg) (*dns.Msg, bool) {
+		if req.Question[0].Name == "slow.example.com." {
+			<-release
+		}
+		return new(dns.Msg).SetReply(req), true
+	})
+	defer close(release)
+
+	client := newTestDoTClient(t, addr, certPool, time.Second)
+	if _, err := client.Resolve(context.Background(), new(dns.Msg).SetQuestion("a.example.com.", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := client.Resolve(ctx, new(dns.Msg).SetQuestion("slow.example.com.", dns.TypeA)); err == nil {
+		t.Fatal("expected error of cancelled query")
+	}
+	if client.currentConnection() == nil {
+		t.Fatal("connection was dropped after cancelled query")
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("got %d connections, want 1", got)
+	}
+}
+
+func newTestDoTClient(t *testing.T, addr string, certPool *x509.CertPool, timeout time.Duration) *dotClient {
+	t.Helper()
+	resolver, err := NewDoTClient("tls://"+addr+"?server_name=localhost", timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := resolver.(*dotClient)
+	client.tlsConfig.RootCAs = certPool
+	t.Cleanup(func() {
+		if conn := client.currentConnection(); conn != nil {
+			client.dropConnection(conn)
+		}
+	})
+	return client
+}
+
+func startDoTTestServer(t *testing.T, handler dotTestHandler) (string, *x509.CertPool, *atomic.Int32) {
+	t.Helper()
+	cert, certPool := newTestCertificate(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	var conns atomic.Int32
+	go func() {
+		for {
+			netConn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			n := int(conns.Add(1)) - 1
+			go func() {
+				conn := &dns.Conn{Conn: netConn}
+				defer conn.Close()
+				for {
+					req, err := conn.ReadMsg()
+					if err != nil {
+						return
+					}
+					resp, ok := handler(n, req)
+					if !ok {
+						return
+					}
+					if resp != nil {
+						if err := conn.WriteMsg(resp); err != nil {
+							return
+						}
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), certPool, &conns
+}
+
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+
+	"github.com/mikhailv/keenetic-dns/dns-server/internal/metrics"
+)
+
+type ForwardingRule struct {
+	Domains  DomainSuffixes
+	Resolver DNSResolver
+}
+
+var _ DNSResolver = forwardingResolver{}
+
+type forwardingResolver struct {
+	rules    []ForwardingRule
+	resolver DNSResolver
+}
+
+func NewForwardingDNSResolver(resolver DNSResolver, rules []ForwardingRule) DNSResolver {
+	if len(rules) == 0 {
+		return resolver
+	}
+	return forwardingResolver{rules, resolver}
+}
+
+func (s forwardingResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if rule, suffix := s.lookupRule(msg); rule != nil {
+		metrics.TrackStatus("dns.forward", suffix)
+		return rule.Resolver.Resolve(ctx, msg)
+	}
+	return s.resolver.Resolve(ctx, msg)
+}
+
+func (s forwardingResolver) lookupRule(msg *dns.Msg) (rule *ForwardingRule, suffix string) {
+	if !hasSingleQuestion(msg) {
+		return nil, ""
+	}
+	for i := range s.rules {
+		if match := s.rules[i].Domains.Match(msg.Question[0].Name); len(match) > len(suffix) {
+			rule, suffix = &s.rules[i], match
+		}
+	}
+	return rule, suffix
+}
@@ -0,0 +1,313 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	geoSitePrefix = "geosite:"
+	geoIPPrefix   = "geoip:"
+)
+
+// v2fly geosite domain types
+const (
+	geoSiteDomainPlain  = 0 // keyword, matches a substring of the name
+	geoSiteDomainRegex  = 1
+	geoSiteDomainDomain = 2 // the domain with subdomains
+	geoSiteDomainFull   = 3 // the domain only
+)
+
+// geoSiteRef parses `geosite:category[@attribute]` host pattern, optionally prefixed with `!` for exclusion.
+func geoSiteRef(pattern string) (ref string, exclude, ok bool) {
+	pattern, exclude = strings.CutPrefix(strings.TrimSpace(pattern), "!")
+	ref, ok = strings.CutPrefix(pattern, geoSitePrefix)
+	return strings.ToLower(ref), exclude, ok
+}
+
+// geoIPRef parses `geoip:code` static address.
+func geoIPRef(addr string) (code string, ok bool) {
+	code, ok = strings.CutPrefix(strings.TrimSpace(addr), geoIPPrefix)
+	return strings.ToLower(code), ok
+}
+
+// loadGeoData resolves geosite references of hosts and geoip references of static addresses
+// from v2fly geosite.dat and geoip.dat files, the files are read only when referenced.
+func (c *RoutingDynamicConfig) loadGeoData(dir string) error {
+	var sites, ips []string
+	for _, patterns := range c.Hosts {
+		for _, pattern := range patterns {
+			if ref, _, ok := geoSiteRef(pattern); ok {
+				sites = append(sites, ref)
+			}
+		}
+	}
+	for _, addresses := range c.Static {
+		for _, addr := range addresses {
+			if code, ok := geoIPRef(addr); ok {
+				ips = append(ips, code)
+			}
+		}
+	}
+
+	if len(sites) > 0 {
+		c.GeoSiteFile = resolvePath(dir, c.GeoSiteFile)
+		categories, err := loadGeoSite(c.GeoSiteFile, sites)
+		if err != nil {
+			return fmt.Errorf("routing.geosite_file: %w", err)
+		}
+		for iface, patterns := range c.Hosts {
+			for i, pattern := range patterns {
+				ref, exclude, ok := geoSiteRef(pattern)
+				if !ok {
+					continue
+				}
+				category, found := categories[ref]
+				if !found {
+					return fmt.Errorf("routing.hosts.%s[%d]: geosite category '%s' not found", iface, i, ref)
+				}
+				for _, pattern := range category.patterns {
+					if exclude {
+						pattern = pattern.excluded()
+					}
+					c.fileHosts[iface] = append(c.fileHosts[iface], pattern)
+				}
+				if category.skipped > 0 {
+					c.geoSiteSkipped[ref] = category.skipped
+				}
+			}
+		}
+	}
+
+	if len(ips) > 0 {
+		c.GeoIPFile = resolvePath(dir, c.GeoIPFile)
+		codes, err := loadGeoIP(c.GeoIPFile, ips)
+		if err != nil {
+			return fmt.Errorf("routing.geoip_file: %w", err)
+		}
+		for iface, addresses := range c.Static {
+			for i, addr := range addresses {
+				code, ok := geoIPRef(addr)
+				if !ok {
+					continue
+				}
+				cidrs, found := codes[code]
+				if !found {
+					return fmt.Errorf("routing.static.%s[%d]: geoip code '%s' not found", iface, i, code)
+				}
+				c.fileStatic[iface] = append(c.fileStatic[iface], cidrs...)
+			}
+		}
+	}
+	return nil
+}
+
+type geoSiteCategory struct {
+	patterns []hostPattern
+	skipped  int // number of domains which can't be represented as host patterns
+}
+
+// loadGeoSite returns host patterns of the referenced geosite categories, a reference is
+// a category name optionally followed by `@attribute` to select only domains having the attribute.
+// Domains which can't be represented as host patterns are skipped.
+func loadGeoSite(file string, refs []string) (map[string]geoSiteCategory, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read geosite file: %w", err)
+	}
+
+	res := map[string]geoSiteCategory{}
+	// message GeoSiteList { repeated GeoSite entry = 1; }
+	err = parseProtoFields(data, func(f protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		// message GeoSite { string country_code = 1; repeated Domain domain = 2; }
+		var category string
+		var domains [][]byte
+		if err := parseProtoFields(f.bytes, func(f protoField) error {
+			switch f.num {
+			case 1:
+				category = strings.ToLower(string(f.bytes))
+			case 2:
+				domains = append(domains, f.bytes)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, ref := range refs {
+			name, attr, _ := strings.Cut(ref, "@")
+			if name != category {
+				continue
+			}
+			var category geoSiteCategory
+			for _, domain := range domains {
+				pattern, attrs, ok, err := parseGeoSiteDomain(domain)
+				if err != nil {
+					return err
+				}
+				if attr != "" && !slices.Contains(attrs, attr) {
+					continue
+				}
+				if ok {
+					category.patterns = append(category.patterns, pattern)
+				} else {
+					category.skipped++
+				}
+			}
+			res[ref] = category
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse geosite file: %w", err)
+	}
+	return res, nil
+}
+
+// parseGeoSiteDomain converts geosite domain to host pattern, ok is false for domains which can't be represented
+// as host patterns, e.g. invalid regular expressions.
+func parseGeoSiteDomain(b []byte) (pattern hostPattern, attrs []string, ok bool, err error) {
+	// message Domain { Type type = 1; string value = 2; repeated Attribute attribute = 3; }
+	// message Attribute { string key = 1; oneof typed_value { bool bool_value = 2; int64 int_value = 3; } }
+	var typ uint64
+	var value string
+	err = parseProtoFields(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			typ = f.varint
+		case 2:
+			value = string(f.bytes)
+		case 3:
+			return parseProtoFields(f.bytes, func(f protoField) error {
+				if f.num == 1 {
+					attrs = append(attrs, strings.ToLower(string(f.bytes)))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return pattern, nil, false, err
+	}
+
+	var s string
+	switch typ {
+	case geoSiteDomainPlain:
+		return newKeywordHostPattern(value), attrs, value != "", nil
+	case geoSiteDomainRegex:
+		s = "/" + value + "/"
+	case geoSiteDomainDomain:
+		s = value
+	case geoSiteDomainFull:
+		s = "=" + value
+	default:
+		return pattern, attrs, false, nil
+	}
+	pattern, parseErr := parseHostPattern(s)
+	return pattern, attrs, parseErr == nil, nil
+}
+
+// loadGeoIP returns IPv4 networks of the referenced geoip codes, IPv6 networks are skipped.
+func loadGeoIP(file string, codes []string) (map[string][]IPv4, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read geoip file: %w", err)
+	}
+
+	res := map[string][]IPv4{}
+	// message GeoIPList { repeated GeoIP entry = 1; }
+	err = parseProtoFields(data, func(f protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		// message GeoIP { string country_code = 1; repeated CIDR cidr = 2; }
+		var code string
+		var cidrs [][]byte
+		if err := parseProtoFields(f.bytes, func(f protoField) error {
+			switch f.num {
+			case 1:
+				code = strings.ToLower(string(f.bytes))
+			case 2:
+				cidrs = append(cidrs, f.bytes)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if !slices.Contains(codes, code) {
+			return nil
+		}
+
+		addrs := []IPv4{}
+		for _, cidr := range cidrs {
+			// message CIDR { bytes ip = 1; uint32 prefix = 2; }
+			var ip []byte
+			var prefix uint64
+			if err := parseProtoFields(cidr, func(f protoField) error {
+				switch f.num {
+				case 1:
+					ip = f.bytes
+				case 2:
+					prefix = f.varint
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if len(ip) == net.IPv4len && prefix <= 32 {
+				addrs = append(addrs, newIPv4(ip, int(prefix)))
+			}
+		}
+		res[code] = addrs
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse geoip file: %w", err)
+	}
+	return res, nil
+}
+
+type protoField struct {
+	num    protowire.Number
+	bytes  []byte // value of length-delimited field
+	varint uint64 // value of varint field
+}
+
+// parseProtoFields calls fn for each field of protobuf encoded message.
+func parseProtoFields(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := protoField{num: num}
+		switch typ {
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
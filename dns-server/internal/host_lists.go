@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// hostsFileLocalNames are names of hosts file entries describing the local machine, they are never routed.
+var hostsFileLocalNames = []string{
+	"localhost", "localhost.localdomain", "local", "broadcasthost",
+	"ip6-localhost", "ip6-loopback", "ip6-localnet", "ip6-mcastprefix", "ip6-allnodes", "ip6-allrouters", "ip6-allhosts",
+}
+
+// loadHostFiles reads host list files of routing groups, relative paths are resolved against the dir.
+// The file paths are replaced with resolved ones to watch them for changes.
+func (c *RoutingDynamicConfig) loadHostFiles(dir string) error {
+	for iface, files := range c.HostFiles {
+		for i, file := range files {
+			file = resolvePath(dir, file)
+			files[i] = file
+			hosts, err := loadHostList(file)
+			if err != nil {
+				return fmt.Errorf("routing.host_files.%s[%d]: %w", iface, i, err)
+			}
+			c.fileHosts[iface] = append(c.fileHosts[iface], hosts...)
+		}
+	}
+	return nil
+}
+
+// ReferencedFiles returns paths of host list and geo data files the routing config is loaded from.
+func (c *RoutingDynamicConfig) ReferencedFiles() []string {
+	var res []string
+	for _, files := range c.HostFiles {
+		res = append(res, files...)
+	}
+	for _, patterns := range c.Hosts {
+		if slices.ContainsFunc(patterns, func(p string) bool { _, _, ok := geoSiteRef(p); return ok }) {
+			res = append(res, c.GeoSiteFile)
+			break
+		}
+	}
+	for _, addresses := range c.Static {
+		if slices.ContainsFunc(addresses, func(a string) bool { _, ok := geoIPRef(a); return ok }) {
+			res = append(res, c.GeoIPFile)
+			break
+		}
+	}
+	slices.Sort(res)
+	return slices.Compact(res)
+}
+
+func resolvePath(dir, file string) string {
+	if file == "" || filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(dir, file)
+}
+
+// loadHostList reads host patterns from the file, each line is in one of the formats:
+//
+//	example.com                           plain host pattern (see hostPattern)
+//	0.0.0.0 example.com www.example.com   hosts file entry, the names are matched exactly
+//	server=/example.com/example.org/      dnsmasq option, the domains are matched with subdomains
+//
+// Text after `#` is a comment.
+func loadHostList(file string) ([]hostPattern, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open host list: %w", err)
+	}
+	defer f.Close()
+
+	var hosts []hostPattern
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		for _, s := range parseHostListLine(scanner.Text()) {
+			pattern, err := parseHostPattern(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid pattern '%s': %w", file, lineNum, s, err)
+			}
+			hosts = append(hosts, pattern)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read host list: %w", err)
+	}
+	return hosts, nil
+}
+
+// dnsmasqOptionRegexp matches dnsmasq options listing domains, the submatch is the domains followed by option value.
+var dnsmasqOptionRegexp = regexp.MustCompile(`^\s*(?:server|address|ipset|nftset)=/(\S*)\s*$`)
+
+func parseHostListLine(line string) []string {
+	line, _, _ = strings.Cut(line, "#")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	if m := dnsmasqOptionRegexp.FindStringSubmatch(line); m != nil {
+		// dnsmasq option: server=/domain1/domain2/upstream, the last part is option value
+		domains := strings.Split(m[1], "/")
+		return slices.DeleteFunc(domains[:len(domains)-1], func(d string) bool { return d == "" })
+	}
+
+	if _, err := netip.ParseAddr(fields[0]); err == nil && len(fields) > 1 {
+		var res []string
+		for _, name := range fields[1:] {
+			if !slices.Contains(hostsFileLocalNames, strings.ToLower(name)) {
+				res = append(res, "="+name)
+			}
+		}
+		return res
+	}
+
+	return fields[:1]
+}
@@ -74,6 +74,7 @@ func (s *IPRouteController) Routes() []IPRouteDNS {
 }
 
 func (s *IPRouteController) Start(ctx context.Context) {
+	s.logConfigWarnings(&s.cfg.Load().RoutingDynamicConfig)
 	s.init(s.cfg.Load())
 	s.reconcile(ctx)
 	go util.RunPeriodically(ctx, s.reconcileInterval, s.reconcile)
@@ -84,9 +85,20 @@ func (s *IPRouteController) UpdateConfig(ctx context.Context, cfg RoutingDynamic
 	current.RoutingDynamicConfig = cfg
 	s.cfg.Store(&current)
 	s.logger.Info("routing config updated")
+	s.logConfigWarnings(&cfg)
 	s.reconcile(ctx)
 }
 
+func (s *IPRouteController) logConfigWarnings(cfg *RoutingDynamicConfig) {
+	for _, conflict := range cfg.HostConflicts() {
+		s.logger.Warn("host pattern is listed for several interfaces", "pattern", conflict.Pattern, "ifaces", conflict.Ifaces, "chosen", conflict.Chosen)
+	}
+	skipped := cfg.GeoSiteSkipped()
+	for _, category := range slices.Sorted(maps.Keys(skipped)) {
+		s.logger.Warn("geosite domains skipped as unsupported", "category", category, "count", skipped[category])
+	}
+}
+
 func (s *IPRouteController) init(cfg *RoutingConfig) {
 	for _, rec := range s.dnsStore.Records() {
 		if iface := cfg.LookupHost(rec.Domain); iface != "" {
@@ -150,7 +162,7 @@ func (s *IPRouteController) reconcileRoutes(ctx context.Context, cfg *RoutingCon
 		}
 	}
 
-	for iface, addresses := range cfg.Static {
+	for iface, addresses := range cfg.StaticAddrs() {
 		for _, addr := range addresses {
 			addRoute(IPRoute{cfg.Rule.Table, iface, addr})
 		}
@@ -47,6 +47,8 @@ func (s *mdnsClient) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error
 		return nil, err
 	}
 
+	setDNSQueryUpstream(ctx, "mdns")
+
 	resp := msg.Copy()
 	resp.Response = true
 	resp.Answer = []dns.RR{&dns.A{
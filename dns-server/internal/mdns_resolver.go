@@ -2,7 +2,6 @@ package internal
 
 import (
 	"context"
-	"strings"
 
 	"github.com/miekg/dns"
 )
@@ -31,12 +30,5 @@ func (s mdnsResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 }
 
 func (s mdnsResolver) shouldProcessQuery(msg *dns.Msg) bool {
-	if hasSingleQuestion(msg, dns.TypeA) {
-		for _, domain := range s.cfg.Domains {
-			if strings.HasSuffix(msg.Question[0].Name, domain) {
-				return true
-			}
-		}
-	}
-	return false
+	return hasSingleQuestion(msg, dns.TypeA) && s.cfg.Domains.MatchSubdomain(msg.Question[0].Name)
 }
@@ -24,6 +24,16 @@ var (
 		Namespace: promNamespace,
 		Name:      "operation_status",
 	}, []string{"op", "status"})
+
+	upstreamHealthyGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "upstream_healthy",
+	}, []string{"upstream", "address"})
+
+	dnsCacheEntriesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "dns_cache_entries",
+	})
 )
 
 func TrackDuration(operation string) func() {
@@ -36,3 +46,44 @@ func TrackDuration(operation string) func() {
 func TrackStatus(operation, status string) {
 	operationStatusCounter.WithLabelValues(operation, status).Inc()
 }
+
+func SetUpstreamHealthy(upstream, address string, healthy bool) {
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	upstreamHealthyGauge.WithLabelValues(upstream, address).Set(value)
+}
+
+func SetDNSCacheEntries(count int) {
+	dnsCacheEntriesGauge.Set(float64(count))
+}
+
+// RegisterStreamDroppedNotifications exposes the number of stream notifications dropped because of slow listeners,
+// labeled by the listener name to identify the slow one.
+func RegisterStreamDroppedNotifications(stream string, dropped func() map[string]uint64) {
+	prometheus.MustRegister(&streamDroppedCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(promNamespace, "", "stream_dropped_notifications"),
+			"Number of stream notifications dropped because of slow listeners.",
+			[]string{"subscriber"},
+			prometheus.Labels{"stream": stream},
+		),
+		dropped: dropped,
+	})
+}
+
+type streamDroppedCollector struct {
+	desc    *prometheus.Desc
+	dropped func() map[string]uint64
+}
+
+func (c *streamDroppedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *streamDroppedCollector) Collect(ch chan<- prometheus.Metric) {
+	for subscriber, count := range c.dropped() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(count), subscriber)
+	}
+}
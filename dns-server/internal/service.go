@@ -9,8 +9,10 @@ import (
 	"slices"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
 
 	"github.com/mikhailv/keenetic-dns/internal/stream"
 	"github.com/mikhailv/keenetic-dns/internal/util"
@@ -53,22 +55,53 @@ func (s *DNSRoutingService) RawQueryStream() *stream.Buffered[DNSRawQuery] {
 }
 
 func (s *DNSRoutingService) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	ctx, info := withDNSQueryInfo(ctx)
+
 	s.appendRawQuery(ctx, false, msg.String())
 
 	resp, err := s.resolver.Resolve(ctx, msg)
+	query := newDNSQuery(ctx, msg, info, start)
 	if err != nil {
 		s.appendRawQuery(ctx, true, fmt.Sprintf("ERROR: query (id: %d) failed: %v", msg.Id, err))
+		query.Error = err.Error()
+		s.appendQuery(query)
 		return nil, err
 	}
 	s.appendRawQuery(ctx, true, resp.String())
 
+	query.Rcode = dns.RcodeToString[resp.Rcode]
+	query.TTL = minResponseTTL(resp)
+	query.Answers = answersSummary(resp)
 	if hasSingleQuestion(msg, dns.TypeA) {
-		s.processTypeAResponse(ctx, resp)
+		s.processTypeAResponse(ctx, resp, &query)
 	}
+	s.appendQuery(query)
 
 	return resp, nil
 }
 
+func newDNSQuery(ctx context.Context, msg *dns.Msg, info *dnsQueryInfo, start time.Time) DNSQuery {
+	query := DNSQuery{
+		Time:       time.Now(),
+		ClientAddr: getDNSQueryRemoteAddr(ctx),
+		Cached:     info.cached,
+		Upstream:   info.upstream,
+		LatencyMs:  float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if len(msg.Question) > 0 {
+		query.Domain = normalizeName(msg.Question[0].Name)
+		query.Type = dns.TypeToString[msg.Question[0].Qtype]
+	}
+	return query
+}
+
+func (s *DNSRoutingService) appendQuery(query DNSQuery) {
+	s.queryStream.Append(query)
+	s.logger.Debug("domain resolved", "domain", query.Domain, "type", query.Type, "rcode", query.Rcode,
+		"answers", len(query.Answers), "client_addr", query.ClientAddr, "cached", query.Cached)
+}
+
 func (s *DNSRoutingService) appendRawQuery(ctx context.Context, response bool, text string) {
 	s.rawQueryStream.Append(DNSRawQuery{
 		Time:       time.Now(),
@@ -78,8 +111,8 @@ func (s *DNSRoutingService) appendRawQuery(ctx context.Context, response bool, t
 	})
 }
 
-func (s *DNSRoutingService) processTypeAResponse(ctx context.Context, resp *dns.Msg) {
-	reqName := resp.Question[0].Name
+func (s *DNSRoutingService) processTypeAResponse(ctx context.Context, resp *dns.Msg, query *DNSQuery) {
+	reqName := dns.CanonicalName(resp.Question[0].Name)
 
 	var cnames util.LazyMap[string, dns.CNAME]
 	var ttl uint32 = math.MaxUint32
@@ -88,10 +121,11 @@ func (s *DNSRoutingService) processTypeAResponse(ctx context.Context, resp *dns.
 	for _, rr := range resp.Answer {
 		switch v := rr.(type) {
 		case *dns.A:
-			nameIPs[v.Hdr.Name] = append(nameIPs[v.Hdr.Name], NewIPv4(v.A))
+			name := dns.CanonicalName(v.Hdr.Name)
+			nameIPs[name] = append(nameIPs[name], NewIPv4(v.A))
 			ttl = min(ttl, v.Hdr.Ttl)
 		case *dns.CNAME:
-			cnames.Set(v.Hdr.Name, *v)
+			cnames.Set(dns.CanonicalName(v.Hdr.Name), *v)
 		}
 	}
 
@@ -100,12 +134,12 @@ func (s *DNSRoutingService) processTypeAResponse(ctx context.Context, resp *dns.
 	var visited util.Set[string]
 
 	for name := reqName; !visited.Has(name); {
-		if iface := s.ipRoutes.LookupHost(normalizeName(name)); iface != "" {
+		if iface := s.ipRoutes.LookupHost(name); iface != "" {
 			ifaces.Add(iface)
 		}
 		if cn, ok := cnames[name]; ok {
 			visited.Add(name)
-			name = cn.Target
+			name = dns.CanonicalName(cn.Target)
 			ttl = min(ttl, cn.Hdr.Ttl)
 		} else {
 			ips = nameIPs[name]
@@ -117,25 +151,53 @@ func (s *DNSRoutingService) processTypeAResponse(ctx context.Context, resp *dns.
 		slices.SortFunc(ips, func(a, b IPv4) int {
 			return bytes.Compare(a[:], b[:])
 		})
-		res := DNSQuery{
-			Time:       time.Now(),
-			ClientAddr: getDNSQueryRemoteAddr(ctx),
-			Domain:     normalizeName(reqName),
-			TTL:        max(ttl, 1),
-			IPs:        ips,
-			Routed:     ifaces.Values(),
-		}
-		s.queryStream.Append(res)
-		for _, ip := range res.IPs {
-			s.dnsStore.Add(NewDNSRecord(res.Domain, ip, res.Time.Add(time.Duration(res.TTL)*time.Second)))
-			for _, iface := range res.Routed {
+		query.TTL = max(ttl, 1)
+		query.IPs = ips
+		query.Routed = ifaces.Values()
+		for _, ip := range query.IPs {
+			s.dnsStore.Add(NewDNSRecord(query.Domain, ip, query.Time.Add(time.Duration(query.TTL)*time.Second)))
+			for _, iface := range query.Routed {
 				s.ipRoutes.AddRoute(ctx, iface, ip)
 			}
 		}
-		s.logger.Debug("domain resolved", "domain", res.Domain, "ips", len(res.IPs), "client_addr", res.ClientAddr)
 	}
 }
 
+func answersSummary(resp *dns.Msg) []string {
+	if len(resp.Answer) == 0 {
+		return nil
+	}
+	res := make([]string, 0, len(resp.Answer))
+	for _, rr := range resp.Answer {
+		res = append(res, dns.TypeToString[rr.Header().Rrtype]+" "+rrData(rr))
+	}
+	return res
+}
+
+// normalizeName returns lowercase domain name without trailing dot, names are compared in this form
+// as DNS names are case-insensitive and clients may randomize the case of queried names (0x20 encoding).
 func normalizeName(name string) string {
-	return strings.TrimRight(name, ".")
+	return strings.ToLower(strings.TrimRight(name, "."))
+}
+
+// normalizeDomain normalizes configured or searched domain name to match names of DNS queries (see normalizeName),
+// internationalized labels are converted to punycode. ASCII labels are only lowercased, as wildcard
+// and service labels (`*`, `_dmarc`) are not valid IDNA labels and searched names may contain partial labels.
+func normalizeDomain(name string) (string, error) {
+	labels := strings.Split(strings.ToLower(strings.TrimRight(name, ".")), ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		ascii, err := idna.Lookup.ToASCII(label)
+		if err != nil {
+			return "", fmt.Errorf("invalid domain '%s': %w", name, err)
+		}
+		labels[i] = ascii
+	}
+	return strings.Join(labels, "."), nil
+}
+
+func isASCII(s string) bool {
+	return !strings.ContainsFunc(s, func(r rune) bool { return r >= utf8.RuneSelf })
 }
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/mikhailv/keenetic-dns/internal/filter"
 	"github.com/mikhailv/keenetic-dns/internal/stream"
 )
 
@@ -47,6 +48,12 @@ func ParseIPv4(s string) (IPv4, error) {
 			prefix = n
 		}
 	}
+	if ip.To4() == nil {
+		return IPv4{}, fmt.Errorf("invalid IPv4 address '%s'", s)
+	}
+	if prefix < 0 || prefix > 32 {
+		return IPv4{}, fmt.Errorf("invalid IP prefix '%d'", prefix)
+	}
 	return newIPv4(ip, prefix), nil
 }
 
@@ -118,15 +125,42 @@ type DNSQuery struct {
 	Time       time.Time     `json:"time"`
 	ClientAddr string        `json:"client_addr"`
 	Domain     string        `json:"domain"`
+	Type       string        `json:"type"`
+	Rcode      string        `json:"rcode,omitempty"`
 	TTL        uint32        `json:"ttl"`
-	IPs        []IPv4        `json:"ips"`
+	IPs        []IPv4        `json:"ips,omitempty"`
+	Answers    []string      `json:"answers,omitempty"`
 	Routed     []string      `json:"routed,omitempty"`
+	Cached     bool          `json:"cached,omitempty"`
+	Upstream   string        `json:"upstream,omitempty"`
+	LatencyMs  float64       `json:"latency_ms"`
+	Error      string        `json:"error,omitempty"`
 }
 
 func (s *DNSQuery) SetCursor(cursor stream.Cursor) {
 	s.Cursor = cursor
 }
 
+var dnsQueryFilterFields = filter.Fields[DNSQuery]{
+	"client":   func(val DNSQuery) []string { return filter.String(clientHost(val.ClientAddr)) },
+	"domain":   func(val DNSQuery) []string { return filter.String(val.Domain) },
+	"type":     func(val DNSQuery) []string { return filter.String(val.Type) },
+	"rcode":    func(val DNSQuery) []string { return filter.String(val.Rcode) },
+	"ttl":      func(val DNSQuery) []string { return filter.Number(val.TTL) },
+	"ip":       func(val DNSQuery) []string { return filter.Strings(val.IPs) },
+	"answer":   func(val DNSQuery) []string { return val.Answers },
+	"routed":   func(val DNSQuery) []string { return val.Routed },
+	"cached":   func(val DNSQuery) []string { return filter.Bool(val.Cached) },
+	"upstream": func(val DNSQuery) []string { return filter.String(val.Upstream) },
+	"latency":  func(val DNSQuery) []string { return filter.Number(val.LatencyMs) },
+	"error":    func(val DNSQuery) []string { return filter.String(val.Error) },
+}
+
+// dnsQueryFilterNormalizers normalizes domain names of filter expressions the same way as names of DNS queries.
+var dnsQueryFilterNormalizers = filter.Normalizers{
+	"domain": normalizeDomain,
+}
+
 var _ stream.CursorAware = (*DNSRawQuery)(nil)
 
 type DNSRawQuery struct {
@@ -141,6 +175,20 @@ func (s *DNSRawQuery) SetCursor(cursor stream.Cursor) {
 	s.Cursor = cursor
 }
 
+var dnsRawQueryFilterFields = filter.Fields[DNSRawQuery]{
+	"client":   func(val DNSRawQuery) []string { return filter.String(clientHost(val.ClientAddr)) },
+	"response": func(val DNSRawQuery) []string { return filter.Bool(val.Response) },
+	"text":     func(val DNSRawQuery) []string { return filter.String(val.Text) },
+}
+
+// clientHost returns host part of the client address, or the address as is if it has no port.
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
 type IPRoute struct {
 	Table int    `json:"table"`
 	Iface string `json:"iface"`
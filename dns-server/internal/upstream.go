@@ -0,0 +1,245 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mikhailv/keenetic-dns/dns-server/internal/metrics"
+)
+
+const upstreamLatencyEWMAWeight = 0.2
+
+func NewUpstreamClient(address string, timeout time.Duration) (DNSResolver, error) {
+	switch {
+	case strings.HasPrefix(address, "http"):
+		return NewDoHClient(address, timeout), nil
+	case strings.HasPrefix(address, "tls://"):
+		return NewDoTClient(address, timeout)
+	default:
+		return NewDNSClient(address, timeout), nil
+	}
+}
+
+// NewUpstreams creates upstreams of the group, upstream ids are made of the group name and upstream index,
+// so that upstreams with the same address in different groups are distinguished.
+func NewUpstreams(group string, addresses []string, timeout time.Duration, cfg DNSUpstreamConfig) ([]*Upstream, error) {
+	upstreams := make([]*Upstream, 0, len(addresses))
+	for i, address := range addresses {
+		client, err := NewUpstreamClient(address, timeout)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, NewUpstream(fmt.Sprintf("%s[%d]", group, i), address, client, cfg))
+	}
+	return upstreams, nil
+}
+
+var _ DNSResolver = (*Upstream)(nil)
+
+// Upstream tracks health of a single upstream, consecutive failures (transport errors and timeouts)
+// take it out of rotation for a cooldown, SERVFAIL answers are not failures.
+// Success rate and latency are only reported by metrics and health endpoint, they don't affect upstream order.
+type Upstream struct {
+	id       string
+	name     string
+	resolver DNSResolver
+	cfg      DNSUpstreamConfig
+
+	mu                  sync.Mutex
+	requests            uint64
+	failures            uint64
+	consecutiveFailures int
+	latency             time.Duration
+	downUntil           time.Time
+	lastError           string
+}
+
+type UpstreamHealth struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Healthy     bool       `json:"healthy"`
+	Requests    uint64     `json:"requests"`
+	Failures    uint64     `json:"failures"`
+	SuccessRate float64    `json:"success_rate"`
+	LatencyMs   float64    `json:"latency_ms"`
+	DownUntil   *time.Time `json:"down_until,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+func NewUpstream(id, name string, resolver DNSResolver, cfg DNSUpstreamConfig) *Upstream {
+	metrics.SetUpstreamHealthy(id, name, true)
+	return &Upstream{
+		id:       id,
+		name:     name,
+		resolver: resolver,
+		cfg:      cfg,
+	}
+}
+
+func (s *Upstream) ID() string {
+	return s.id
+}
+
+func (s *Upstream) Name() string {
+	return s.name
+}
+
+func (s *Upstream) Available() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().After(s.downUntil)
+}
+
+func (s *Upstream) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	operation := "upstream:" + s.id
+	defer metrics.TrackDuration(operation)()
+
+	start := time.Now()
+	resp, err := s.resolver.Resolve(ctx, msg)
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		// request was cancelled by the caller, it says nothing about upstream health
+		metrics.TrackStatus(operation, "cancelled")
+		return resp, err
+	}
+
+	s.track(time.Since(start), err)
+	switch {
+	case err != nil:
+		metrics.TrackStatus(operation, "failed")
+	case resp.Rcode == dns.RcodeServerFailure:
+		// SERVFAIL is usually caused by the queried domain (broken authoritative servers, bogus DNSSEC),
+		// so it doesn't affect upstream health, but the next upstream is still tried
+		metrics.TrackStatus(operation, "servfail")
+		err = errUpstreamServerFailure
+	default:
+		metrics.TrackStatus(operation, "success")
+		setDNSQueryUpstream(ctx, s.name) // only the upstream which answered, failed attempts are followed by the next one
+	}
+	return resp, err
+}
+
+func (s *Upstream) track(latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	if err != nil {
+		s.failures++
+		s.consecutiveFailures++
+		s.lastError = err.Error()
+		if s.consecutiveFailures >= max(1, s.cfg.FailureThreshold) {
+			s.downUntil = time.Now().Add(s.cfg.Cooldown)
+			metrics.SetUpstreamHealthy(s.id, s.name, false)
+		}
+		return
+	}
+
+	s.consecutiveFailures = 0
+	s.downUntil = time.Time{}
+	if s.latency == 0 {
+		s.latency = latency
+	} else {
+		s.latency += time.Duration(upstreamLatencyEWMAWeight * float64(latency-s.latency))
+	}
+	metrics.SetUpstreamHealthy(s.id, s.name, true)
+}
+
+func (s *Upstream) Health() UpstreamHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := UpstreamHealth{
+		ID:          s.id,
+		Name:        s.name,
+		Healthy:     time.Now().After(s.downUntil),
+		Requests:    s.requests,
+		Failures:    s.failures,
+		SuccessRate: 1,
+		LatencyMs:   float64(s.latency.Microseconds()) / 1000,
+		LastError:   s.lastError,
+	}
+	if s.requests > 0 {
+		res.SuccessRate = float64(s.requests-s.failures) / float64(s.requests)
+	}
+	if !res.Healthy {
+		downUntil := s.downUntil
+		res.DownUntil = &downUntil
+	}
+	return res
+}
+
+var (
+	errUpstreamServerFailure = errors.New("upstream: server failure")
+	errNoUpstreams           = errors.New("upstream: no upstreams configured")
+)
+
+var _ DNSResolver = failoverDNSResolver{}
+
+type failoverDNSResolver struct {
+	upstreams      []*Upstream
+	attemptTimeout time.Duration
+}
+
+func NewUpstreamsDNSResolver(upstreams []*Upstream, cfg DNSUpstreamConfig) DNSResolver {
+	if cfg.Strategy == UpstreamStrategyRace {
+		return NewRacingDNSResolver(upstreams, cfg.HedgeDelay)
+	}
+	return NewFailoverDNSResolver(upstreams, cfg.AttemptTimeout)
+}
+
+// NewFailoverDNSResolver returns resolver trying upstreams one by one, every upstream but the last one
+// is waited for at most attemptTimeout (if positive) before the next one is tried.
+func NewFailoverDNSResolver(upstreams []*Upstream, attemptTimeout time.Duration) DNSResolver {
+	return failoverDNSResolver{upstreams, attemptTimeout}
+}
+
+func (s failoverDNSResolver) Resolve(ctx context.Context, msg *dns.Msg) (resp *dns.Msg, err error) {
+	err = errNoUpstreams
+	upstreams := orderUpstreams(s.upstreams)
+	for i, upstream := range upstreams {
+		resp, err = s.attempt(ctx, upstream, msg, i == len(upstreams)-1)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	return upstreamsResult(resp, err)
+}
+
+func (s failoverDNSResolver) attempt(ctx context.Context, upstream *Upstream, msg *dns.Msg, last bool) (*dns.Msg, error) {
+	if last || s.attemptTimeout <= 0 {
+		return upstream.Resolve(ctx, msg)
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.attemptTimeout)
+	defer cancel()
+	return upstream.Resolve(ctx, msg)
+}
+
+func upstreamsResult(resp *dns.Msg, err error) (*dns.Msg, error) {
+	if errors.Is(err, errUpstreamServerFailure) {
+		return resp, nil // pass SERVFAIL from the last upstream to the client as is
+	}
+	if err != nil {
+		return nil, fmt.Errorf("upstream: all upstreams failed: %w", err)
+	}
+	return resp, nil
+}
+
+// orderUpstreams returns available upstreams in priority order followed by the ones in cooldown,
+// so that the query is still attempted when every upstream is considered down.
+func orderUpstreams(upstreams []*Upstream) []*Upstream {
+	res := make([]*Upstream, 0, len(upstreams))
+	var down []*Upstream
+	for _, upstream := range upstreams {
+		if upstream.Available() {
+			res = append(res, upstream)
+		} else {
+			down = append(down, upstream)
+		}
+	}
+	return append(res, down...)
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mikhailv/keenetic-dns/dns-server/internal/metrics"
+)
+
+var _ DNSResolver = racingDNSResolver{}
+
+type racingDNSResolver struct {
+	upstreams  []*Upstream
+	hedgeDelay time.Duration
+}
+
+type raceResult struct {
+	upstream *Upstream
+	resp     *dns.Msg
+	err      error
+}
+
+func NewRacingDNSResolver(upstreams []*Upstream, hedgeDelay time.Duration) DNSResolver {
+	return racingDNSResolver{upstreams, hedgeDelay}
+}
+
+func (s racingDNSResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	defer metrics.TrackDuration("dns.race")()
+
+	upstreams := orderUpstreams(s.upstreams)
+	if len(upstreams) == 0 {
+		return nil, errNoUpstreams
+	}
+
+	raceCtx, cancel := context.WithCancel(withoutDNSQueryInfo(ctx))
+	defer cancel() // cancel requests which are still in flight
+
+	results := make(chan raceResult, len(upstreams))
+	started := 0
+	startNext := func() bool {
+		if started == len(upstreams) {
+			return false
+		}
+		upstream := upstreams[started]
+		started++
+		go func() {
+			resp, err := upstream.Resolve(raceCtx, msg.Copy())
+			results <- raceResult{upstream, resp, err}
+		}()
+		return true
+	}
+
+	startNext()
+	pending := 1
+
+	hedgeTimer := time.NewTimer(s.hedgeDelay)
+	defer hedgeTimer.Stop()
+
+	var lastResp *dns.Msg
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-hedgeTimer.C:
+			if startNext() {
+				pending++
+				hedgeTimer.Reset(s.hedgeDelay)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				metrics.TrackStatus("dns.race", res.upstream.ID())
+				setDNSQueryUpstream(ctx, res.upstream.Name())
+				return res.resp, nil
+			}
+			lastResp, lastErr = res.resp, res.err
+			if startNext() { // do not wait for the hedge delay when an upstream has already failed
+				pending++
+			}
+		}
+	}
+	metrics.TrackStatus("dns.race", "failed")
+	return upstreamsResult(lastResp, lastErr)
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRacingDNSResolver(t *testing.T) {
+	const hedgeDelay = 100 * time.Millisecond
+
+	tests := []struct {
+		name      string
+		resolvers []*testResolver
+		upstream  string // upstream which answered
+		rcode     int
+		err       bool
+		calls     []int32
+		maxTime   time.Duration
+	}{
+		{
+			name:      "fast upstream doesn't start hedged queries",
+			resolvers: []*testResolver{{}, {}},
+			upstream:  "a",
+			calls:     []int32{1, 0},
+			maxTime:   hedgeDelay / 2,
+		},
+		{
+			name:      "hedged query wins over slow upstream",
+			resolvers: []*testResolver{{delay: time.Second}, {}},
+			upstream:  "b",
+			calls:     []int32{1, 1},
+			maxTime:   hedgeDelay * 3 / 2,
+		},
+		{
+			name:      "slow upstream wins over slower hedged query",
+			resolvers: []*testResolver{{delay: hedgeDelay * 3 / 2}, {delay: time.Second}},
+			upstream:  "a",
+			calls:     []int32{1, 1},
+			maxTime:   hedgeDelay * 2,
+		},
+		{
+			name:      "failure starts the next upstream without waiting for hedge delay",
+			resolvers: []*testResolver{{err: errTestUpstream}, {rcode: dns.RcodeServerFailure}, {}},
+			upstream:  "c",
+			calls:     []int32{1, 1, 1},
+			maxTime:   hedgeDelay / 2,
+		},
+		{
+			name:      "servfail of the last upstream is passed to the client",
+			resolvers: []*testResolver{{err: errTestUpstream}, {rcode: dns.RcodeServerFailure}},
+			rcode:     dns.RcodeServerFailure,
+			calls:     []int32{1, 1},
+			maxTime:   hedgeDelay / 2,
+		},
+		{
+			name:      "all upstreams failed",
+			resolvers: []*testResolver{{err: errTestUpstream}, {err: errTestUpstream}},
+			err:       true,
+			calls:     []int32{1, 1},
+			maxTime:   hedgeDelay / 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreams := newTestUpstreams(t, DNSUpstreamConfig{FailureThreshold: 3}, tt.resolvers...)
+			resolver := NewRacingDNSResolver(upstreams, hedgeDelay)
+
+			ctx, info := withDNSQueryInfo(context.Background())
+			start := time.Now()
+			resp, err := resolver.Resolve(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+			if elapsed := time.Since(start); elapsed > tt.maxTime {
+				t.Errorf("resolved in %s, want at most %s", elapsed, tt.maxTime)
+			}
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if resp.Rcode != tt.rcode {
+					t.Errorf("got rcode %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+				}
+			}
+			if info.upstream != tt.upstream {
+				t.Errorf("answered by '%s', want '%s'", info.upstream, tt.upstream)
+			}
+			for i, resolver := range tt.resolvers {
+				if got := resolver.calls.Load(); got != tt.calls[i] {
+					t.Errorf("upstream %d called %d times, want %d", i, got, tt.calls[i])
+				}
+			}
+		})
+	}
+}
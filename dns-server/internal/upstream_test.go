@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var errTestUpstream = errors.New("connection refused")
+
+// testResolver answers after the delay with the rcode, or fails with the error.
+type testResolver struct {
+	delay time.Duration
+	rcode int
+	err   error
+	calls atomic.Int32
+}
+
+func (s *testResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	s.calls.Add(1)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(s.delay):
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	return new(dns.Msg).SetRcode(msg, s.rcode), nil
+}
+
+func newTestUpstreams(t *testing.T, cfg DNSUpstreamConfig, resolvers ...*testResolver) []*Upstream {
+	t.Helper()
+	upstreams := make([]*Upstream, len(resolvers))
+	for i, resolver := range resolvers {
+		upstreams[i] = NewUpstream(fmt.Sprintf("%s[%d]", t.Name(), i), string(rune('a'+i)), resolver, cfg)
+	}
+	return upstreams
+}
+
+func TestFailoverDNSResolver(t *testing.T) {
+	ok := func() *testResolver { return &testResolver{} }
+	failed := func() *testResolver { return &testResolver{err: errTestUpstream} }
+	servfail := func() *testResolver { return &testResolver{rcode: dns.RcodeServerFailure} }
+	slow := func() *testResolver { return &testResolver{delay: time.Second} }
+
+	tests := []struct {
+		name      string
+		resolvers []*testResolver
+		upstream  string // upstream which answered
+		rcode     int
+		err       bool
+		calls     []int32
+	}{
+		{
+			name:      "first upstream answers",
+			resolvers: []*testResolver{ok(), ok()},
+			upstream:  "a",
+			calls:     []int32{1, 0},
+		},
+		{
+			name:      "failed upstream is followed by the next one",
+			resolvers: []*testResolver{failed(), failed(), ok()},
+			upstream:  "c",
+			calls:     []int32{1, 1, 1},
+		},
+		{
+			name:      "servfail is followed by the next one",
+			resolvers: []*testResolver{servfail(), ok()},
+			upstream:  "b",
+			calls:     []int32{1, 1},
+		},
+		{
+			name:      "attempt timeout",
+			resolvers: []*testResolver{slow(), ok()},
+			upstream:  "b",
+			calls:     []int32{1, 1},
+		},
+		{
+			name:      "servfail of the last upstream is passed to the client",
+			resolvers: []*testResolver{failed(), servfail()},
+			rcode:     dns.RcodeServerFailure,
+			calls:     []int32{1, 1},
+		},
+		{
+			name:      "all upstreams failed",
+			resolvers: []*testResolver{failed(), failed()},
+			err:       true,
+			calls:     []int32{1, 1},
+		},
+		{
+			name: "no upstreams",
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreams := newTestUpstreams(t, DNSUpstreamConfig{FailureThreshold: 3}, tt.resolvers...)
+			resolver := NewFailoverDNSResolver(upstreams, 50*time.Millisecond)
+
+			ctx, info := withDNSQueryInfo(context.Background())
+			resp, err := resolver.Resolve(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if resp.Rcode != tt.rcode {
+					t.Errorf("got rcode %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+				}
+			}
+			if info.upstream != tt.upstream {
+				t.Errorf("answered by '%s', want '%s'", info.upstream, tt.upstream)
+			}
+			for i, resolver := range tt.resolvers {
+				if got := resolver.calls.Load(); got != tt.calls[i] {
+					t.Errorf("upstream %d called %d times, want %d", i, got, tt.calls[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamCooldown(t *testing.T) {
+	primary, secondary := &testResolver{}, &testResolver{}
+	upstreams := newTestUpstreams(t, DNSUpstreamConfig{FailureThreshold: 2, Cooldown: time.Hour}, primary, secondary)
+	resolver := NewFailoverDNSResolver(upstreams, 0)
+
+	steps := []struct {
+		name     string
+		rcode    int
+		err      error
+		upstream string // upstream which answered
+		healthy  bool   // primary health after the query
+	}{
+		{name: "healthy", upstream: "a", healthy: true},
+		{name: "servfail doesn't count", rcode: dns.RcodeServerFailure, upstream: "b", healthy: true},
+		{name: "servfail again", rcode: dns.RcodeServerFailure, upstream: "b", healthy: true},
+		{name: "first failure", err: errTestUpstream, upstream: "b", healthy: true},
+		{name: "success resets failures", upstream: "a", healthy: true},
+		{name: "failure after reset", err: errTestUpstream, upstream: "b", healthy: true},
+		{name: "threshold reached", err: errTestUpstream, upstream: "b", healthy: false},
+		{name: "cooldown skips primary", upstream: "b", healthy: false},
+	}
+	for _, step := range steps {
+		primary.rcode, primary.err = step.rcode, step.err
+		ctx, info := withDNSQueryInfo(context.Background())
+		if _, err := resolver.Resolve(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA)); err != nil {
+			t.Fatalf("%s: unexpected error: %v", step.name, err)
+		}
+		if info.upstream != step.upstream {
+			t.Errorf("%s: answered by '%s', want '%s'", step.name, info.upstream, step.upstream)
+		}
+		if got := upstreams[0].Available(); got != step.healthy {
+			t.Errorf("%s: primary available %v, want %v", step.name, got, step.healthy)
+		}
+	}
+
+	health := upstreams[0].Health()
+	if health.Healthy || health.DownUntil == nil || health.Requests != 7 || health.Failures != 3 {
+		t.Errorf("unexpected primary health: %+v", health)
+	}
+	if got := primary.calls.Load(); got != 7 {
+		t.Errorf("primary called %d times, want 7", got)
+	}
+}
+
+func TestOrderUpstreams(t *testing.T) {
+	upstreams := newTestUpstreams(t, DNSUpstreamConfig{Cooldown: time.Hour}, &testResolver{}, &testResolver{}, &testResolver{})
+	upstreams[0].track(0, errTestUpstream)
+	upstreams[1].track(0, errTestUpstream)
+
+	var got string
+	for _, upstream := range orderUpstreams(upstreams) {
+		got += upstream.Name()
+	}
+	if got != "cab" {
+		t.Errorf("got order '%s', want 'cab'", got)
+	}
+}
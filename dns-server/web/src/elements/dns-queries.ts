@@ -56,9 +56,13 @@ export class DNSRequestsElement extends LitElement {
           <th scope="col">Time</th>
           <th scope="col">Client</th>
           <th scope="col">Domain</th>
+          <th scope="col">Type</th>
+          <th scope="col">Status</th>
           <th scope="col">TTL</th>
-          <th scope="col">IP</th>
+          <th scope="col">Answer</th>
           <th scope="col">Routed</th>
+          <th scope="col">Upstream</th>
+          <th scope="col">Latency</th>
         </tr>
         </thead>
         <tbody class="table-group-divider">
@@ -66,14 +70,21 @@ export class DNSRequestsElement extends LitElement {
           <tr>
             <td title=${it.time.toLocaleString()}>${formatTime(it.time)}</td>
             <td>${it.client_addr.split(':')[0]}</td>
-            <td>${it.domain}</td>
+            <td>
+              ${it.domain}
+              ${it.cached ? html`<span class="badge text-bg-light fw-light" title="Served from cache">cache</span>` : nothing}
+            </td>
+            <td>${it.type}</td>
+            <td title=${it.error ?? ''}>${it.error ? html`<span class="text-danger">ERROR</span>` : it.rcode}</td>
             <td>${it.ttl}</td>
             <td class="fw-light" style="font-size: 0.9rem">
-              ${it.ips.map(ip => html`<div>${ip}</div>`)}
+              ${it.answers?.map(answer => html`<div>${answer}</div>`) ?? '-'}
             </td>
             <td class="fw-light" style="font-size: 0.9rem">
               ${it.routed?.map(iface => html`<div>${iface}</div>`) ?? '-'}
             </td>
+            <td class="fw-light" style="font-size: 0.9rem">${it.upstream ?? '-'}</td>
+            <td class="fw-light" style="font-size: 0.9rem">${it.latency_ms.toFixed(1)} ms</td>
           </tr>
         `)}
         </tbody>
@@ -1,4 +1,4 @@
-import { DNSQuery, IPRoute } from './types';
+import { DNSQuery, IPRoute, StreamGap } from './types';
 import { Stream, websocketStream } from './stream';
 
 export class Service {
@@ -15,11 +15,20 @@ export class Service {
   }
 
   streamDomainResolve(): Stream<DNSQuery[]> {
+    let lastCursor = '';
     return websocketStream<DNSQuery[]>(
-      () => new WebSocket(this.baseUrl + '/api/dns-queries/ws'),
+      // resume after the last received query on reconnect
+      () => new WebSocket(this.baseUrl + '/api/dns-queries/ws' + (lastCursor ? '?after=' + lastCursor : '')),
       data => {
-        const res = JSON.parse(data) as DNSQuery[];
+        const res = JSON.parse(data) as DNSQuery[] | StreamGap;
+        if (!Array.isArray(res)) {
+          console.warn(`dns queries after ${res.after} are lost, the oldest available is ${res.oldest}`);
+          return [];
+        }
         res.forEach(it => it.time = new Date(it.time));
+        if (res.length > 0) {
+          lastCursor = res[res.length - 1].cursor;
+        }
         return res;
       },
     );
@@ -15,9 +15,22 @@ export interface DNSQuery {
   time: Date;
   client_addr: string;
   domain: string;
+  type: string;
+  rcode?: string;
   ttl: number;
-  ips: string[];
+  ips?: string[];
+  answers?: string[];
   routed?: string[];
+  cached?: boolean;
+  upstream?: string;
+  latency_ms: number;
+  error?: string;
+}
+
+export interface StreamGap {
+  type: 'gap';
+  after: string;
+  oldest: string;
 }
 
 export interface LogEntry {
@@ -0,0 +1,326 @@
+// Package filter implements a small expression language to filter stream entries, e.g.
+//
+//	client=192.168.2.15 and domain~*.googlevideo.com and not routed=ovpn_br0
+//
+// Conditions compare entry fields with values using one of the operators:
+//
+//	=, !=      equal, not equal (case-insensitive)
+//	~, !~      match, not match glob pattern with `*` and `?` wildcards, pattern without wildcards matches a substring
+//	<, <=, >, >=  numeric comparison
+//
+// Conditions can be combined with `and`, `or`, `not` and parentheses, values containing spaces,
+// parentheses or operator characters must be double-quoted. A multi-valued field satisfies
+// the condition when any of its values does. Values compared as strings may be normalized per field.
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Fields declares accessors of entry fields available in filter expressions.
+type Fields[T any] map[string]func(val T) []string
+
+// Normalizers declares normalization of values compared with fields as strings, so that a value is compared
+// in the form the field accessor returns, e.g. domain name in punycode. Normalizers are optional.
+type Normalizers map[string]func(value string) (string, error)
+
+// Compile compiles filter expression to a predicate, empty expression compiles to nil predicate.
+func Compile[T any](expr string, fields Fields[T], normalizers Normalizers) (func(val T) bool, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	p := &parser[T]{tokens: tokens, end: len(expr), fields: fields, normalizers: normalizers}
+	res, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("filter: unexpected '%s' at %d", tok.text, tok.pos)
+	}
+	return res, nil
+}
+
+// String returns single value of a field accessor.
+func String(s string) []string {
+	return []string{s}
+}
+
+// Bool returns single value of a boolean field accessor.
+func Bool(b bool) []string {
+	return []string{strconv.FormatBool(b)}
+}
+
+// Number returns single value of a numeric field accessor.
+func Number[N int | int64 | uint32 | float64](n N) []string {
+	return []string{strconv.FormatFloat(float64(n), 'f', -1, 64)}
+}
+
+// Strings returns values of a multi-valued field accessor.
+func Strings[S fmt.Stringer](values []S) []string {
+	res := make([]string, 0, len(values))
+	for _, val := range values {
+		res = append(res, val.String())
+	}
+	return res
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenOperator
+	tokenLParen
+	tokenRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var operators = []string{"!=", "!~", "<=", ">=", "=", "~", "<", ">"}
+
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(expr) && expr[end] != '"' {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("filter: unterminated string at %d", i)
+			}
+			s, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("filter: invalid string at %d: %w", i, err)
+			}
+			tokens = append(tokens, token{tokenString, s, i})
+			i = end + 1
+		default:
+			if op := operatorAt(expr, i); op != "" {
+				tokens = append(tokens, token{tokenOperator, op, i})
+				i += len(op)
+				continue
+			}
+			end := i
+			for end < len(expr) && !strings.ContainsRune(" \t\n()\"", rune(expr[end])) && operatorAt(expr, end) == "" {
+				end++
+			}
+			tokens = append(tokens, token{tokenWord, expr[i:end], i})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+func operatorAt(expr string, i int) string {
+	for _, op := range operators {
+		if strings.HasPrefix(expr[i:], op) {
+			return op
+		}
+	}
+	return ""
+}
+
+type parser[T any] struct {
+	tokens      []token
+	pos         int
+	end         int
+	fields      Fields[T]
+	normalizers Normalizers
+}
+
+func (p *parser[T]) peek() token {
+	if p.pos >= len(p.tokens) {
+		return token{kind: tokenEOF, text: "end of expression", pos: p.end}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser[T]) next() token {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *parser[T]) keyword(word string) bool {
+	if tok := p.peek(); tok.kind == tokenWord && strings.EqualFold(tok.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser[T]) parseOr() (func(val T) bool, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = func(l, r func(val T) bool) func(val T) bool {
+			return func(val T) bool { return l(val) || r(val) }
+		}(left, right)
+	}
+	return left, nil
+}
+
+func (p *parser[T]) parseAnd() (func(val T) bool, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = func(l, r func(val T) bool) func(val T) bool {
+			return func(val T) bool { return l(val) && r(val) }
+		}(left, right)
+	}
+	return left, nil
+}
+
+func (p *parser[T]) parseUnary() (func(val T) bool, error) {
+	if p.keyword("not") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(val T) bool { return !operand(val) }, nil
+	}
+	if p.peek().kind == tokenLParen {
+		p.next()
+		res, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok.kind != tokenRParen {
+			return nil, fmt.Errorf("filter: expected ')' at %d, got '%s'", tok.pos, tok.text)
+		}
+		return res, nil
+	}
+	return p.parseCondition()
+}
+
+func (p *parser[T]) parseCondition() (func(val T) bool, error) {
+	field := p.next()
+	if field.kind != tokenWord {
+		return nil, fmt.Errorf("filter: expected field name at %d, got '%s'", field.pos, field.text)
+	}
+	name := strings.ToLower(field.text)
+	accessor, ok := p.fields[name]
+	if !ok {
+		names := make([]string, 0, len(p.fields))
+		for name := range p.fields {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return nil, fmt.Errorf("filter: unknown field '%s', expected one of: %s", field.text, strings.Join(names, ", "))
+	}
+
+	op := p.next()
+	if op.kind != tokenOperator {
+		return nil, fmt.Errorf("filter: expected operator after '%s' at %d, got '%s'", field.text, op.pos, op.text)
+	}
+
+	// missing value is an empty string, a keyword right after the operator starts the next part of the expression,
+	// so it has to be quoted to be used as a value
+	value := ""
+	if tok := p.peek(); tok.kind == tokenString || (tok.kind == tokenWord && !isKeyword(tok.text)) {
+		value = p.next().text
+	}
+
+	var err error
+	if normalize := p.normalizers[name]; normalize != nil && !isNumericOperator(op.text) {
+		if value, err = normalize(value); err != nil {
+			return nil, fmt.Errorf("filter: invalid condition on '%s' at %d: %w", field.text, field.pos, err)
+		}
+	}
+	match, err := matcher(op.text, value)
+	if err != nil {
+		return nil, fmt.Errorf("filter: invalid condition on '%s' at %d: %w", field.text, field.pos, err)
+	}
+	negate := op.text == "!=" || op.text == "!~"
+	return func(val T) bool {
+		values := accessor(val)
+		if len(values) == 0 {
+			values = []string{""}
+		}
+		return slices.ContainsFunc(values, match) != negate
+	}, nil
+}
+
+func isKeyword(word string) bool {
+	return strings.EqualFold(word, "and") || strings.EqualFold(word, "or") || strings.EqualFold(word, "not")
+}
+
+func isNumericOperator(op string) bool {
+	return op == "<" || op == "<=" || op == ">" || op == ">="
+}
+
+func matcher(op, value string) (func(s string) bool, error) {
+	switch op {
+	case "=", "!=":
+		return func(s string) bool { return strings.EqualFold(s, value) }, nil
+	case "~", "!~":
+		re, err := globRegexp(value)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not a number", value)
+	}
+	compare := map[string]func(a float64) bool{
+		"<":  func(a float64) bool { return a < n },
+		"<=": func(a float64) bool { return a <= n },
+		">":  func(a float64) bool { return a > n },
+		">=": func(a float64) bool { return a >= n },
+	}[op]
+	return func(s string) bool {
+		a, err := strconv.ParseFloat(s, 64)
+		return err == nil && compare(a)
+	}, nil
+}
+
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	if !strings.ContainsAny(pattern, "*?") {
+		pattern = "*" + pattern + "*"
+	}
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, `.*`)
+	expr = strings.ReplaceAll(expr, `\?`, `.`)
+	return regexp.Compile("(?is)^" + expr + "$")
+}
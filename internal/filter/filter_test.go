@@ -0,0 +1,215 @@
+package filter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testEntry struct {
+	Client string
+	Domain string
+	Routed []string
+	TTL    int
+}
+
+var testFields = Fields[testEntry]{
+	"client": func(val testEntry) []string { return String(val.Client) },
+	"domain": func(val testEntry) []string { return String(val.Domain) },
+	"routed": func(val testEntry) []string { return val.Routed },
+	"ttl":    func(val testEntry) []string { return Number(val.TTL) },
+}
+
+func TestCompile(t *testing.T) {
+	entry := testEntry{
+		Client: "192.168.2.15",
+		Domain: "rr1.googlevideo.com",
+		Routed: []string{"ovpn_br0", "wg0"},
+		TTL:    300,
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		// operators
+		{"client=192.168.2.15", true},
+		{"client = 192.168.2.15", true},
+		{"client=192.168.2.1", false},
+		{"client!=192.168.2.1", true},
+		{"domain=RR1.GoogleVideo.com", true},
+		{"domain~*.googlevideo.com", true},
+		{"domain~googlevideo", true},
+		{"domain~rr?.google*", true},
+		{"domain~*.youtube.com", false},
+		{"domain!~youtube", true},
+		{"ttl>299", true},
+		{"ttl>=300", true},
+		{"ttl<300", false},
+		{"ttl<=300", true},
+
+		// multi-valued field matches when any value does, negation when none does
+		{"routed=wg0", true},
+		{"routed!=wg0", false},
+		{"routed!=eth0", true},
+		{"not routed=eth0", true},
+
+		// missing value is an empty string
+		{"domain=", false},
+		{"domain!=", true},
+		{"domain= or client=192.168.2.15", true},
+		{"domain= and client=192.168.2.15", false},
+		{"domain!= AND client=192.168.2.15", true},
+		{"(client=x or domain=) or ttl=300", true},
+
+		// precedence: not > and > or
+		{"client=x or domain~google and ttl>0", true},
+		{"client=x or domain~google and ttl>1000", false},
+		{"(client=x or domain~google) and ttl>1000", false},
+		{"client=192.168.2.15 or client=x and ttl>1000", true},
+		{"(client=192.168.2.15 or client=x) and ttl>1000", false},
+		{"not client=x and ttl>1000", false},
+		{"not (client=x and ttl>1000)", true},
+		{"not not client=192.168.2.15", true},
+		{"client=192.168.2.15 and domain~*.googlevideo.com and not routed=eth0", true},
+
+		// keywords are case-insensitive
+		{"client=x OR ttl=300", true},
+		{"NOT client=x AND Ttl=300", true},
+
+		// quoting
+		{`domain="rr1.googlevideo.com"`, true},
+		{`domain~"*.googlevideo.com"`, true},
+		{`domain!="a b"`, true},
+		{`domain="and"`, false},
+		{`client="192.168.2.15" and routed="ovpn_br0"`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			predicate, err := Compile(tt.expr, testFields, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := predicate(entry); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileQuotedValue(t *testing.T) {
+	tests := []struct {
+		expr  string
+		value string
+	}{
+		{`domain="a b"`, "a b"},
+		{`domain="(x)"`, "(x)"},
+		{`domain="a=b"`, "a=b"},
+		{`domain="or"`, "or"},
+		{`domain="say \"hi\""`, `say "hi"`},
+		{`domain=""`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			predicate, err := Compile(tt.expr, testFields, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !predicate(testEntry{Domain: tt.value}) {
+				t.Errorf("expected to match '%s'", tt.value)
+			}
+			if predicate(testEntry{Domain: tt.value + "x"}) {
+				t.Errorf("expected not to match '%s'", tt.value+"x")
+			}
+		})
+	}
+}
+
+func TestCompileEmpty(t *testing.T) {
+	for _, expr := range []string{"", "  ", "\t\n"} {
+		predicate, err := Compile(expr, testFields, nil)
+		if err != nil || predicate != nil {
+			t.Errorf("Compile(%q) = %v, %v, want nil predicate", expr, predicate != nil, err)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"host=x", "filter: unknown field 'host', expected one of: client, domain, routed, ttl"},
+		{"client=x and host~y", "filter: unknown field 'host', expected one of: client, domain, routed, ttl"},
+		{`domain="abc`, "filter: unterminated string at 7"},
+		{`domain="abc\"`, "filter: unterminated string at 7"},
+		{`domain="\q"`, "filter: invalid string at 7"},
+		{"(client=x", "filter: expected ')' at 9, got 'end of expression'"},
+		{"(client=x client=y)", "filter: expected ')' at 10, got 'client'"},
+		{"client=x)", "filter: unexpected ')' at 8"},
+		{"client=x client=y", "filter: unexpected 'client' at 9"},
+		{"domain= not client=x", "filter: unexpected 'not' at 8"},
+		{"ttl>abc", "filter: invalid condition on 'ttl' at 0: 'abc' is not a number"},
+		{"ttl<", "filter: invalid condition on 'ttl' at 0: '' is not a number"},
+		{"client", "filter: expected operator after 'client' at 6, got 'end of expression'"},
+		{"client x", "filter: expected operator after 'client' at 7, got 'x'"},
+		{"=x", "filter: expected field name at 0, got '='"},
+		{"client=x and", "filter: expected field name at 12, got 'end of expression'"},
+		{"not", "filter: expected field name at 3, got 'end of expression'"},
+		{"()", "filter: expected field name at 1, got ')'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := Compile(tt.expr, testFields, nil)
+			if err == nil {
+				t.Fatalf("expected error '%s'", tt.err)
+			}
+			if !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("got error '%v', want '%s'", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCompileNormalizers(t *testing.T) {
+	normalizers := Normalizers{
+		"domain": func(value string) (string, error) {
+			if value == "bad" {
+				return "", errors.New("bad domain")
+			}
+			return strings.TrimSuffix(value, "."), nil
+		},
+		"ttl": func(string) (string, error) { return "", errors.New("numeric values must not be normalized") },
+	}
+	entry := testEntry{Domain: "example.com", TTL: 300}
+
+	tests := []struct {
+		expr string
+		want bool
+		err  string
+	}{
+		{expr: "domain=example.com.", want: true},
+		{expr: "domain~example.", want: true},
+		{expr: "domain!=example.com.", want: false},
+		{expr: "client=example.com.", want: false},
+		{expr: "ttl>=300", want: true},
+		{expr: "domain=bad", err: "filter: invalid condition on 'domain' at 0: bad domain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			predicate, err := Compile(tt.expr, testFields, normalizers)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error '%v', want '%s'", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := predicate(entry); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -5,11 +5,25 @@ import (
 	"log/slog"
 	"time"
 
+	"github.com/mikhailv/keenetic-dns/internal/filter"
 	"github.com/mikhailv/keenetic-dns/internal/stream"
 )
 
 var _ stream.CursorAware = (*Entry)(nil)
 
+// EntryFilterFields are fields of log entry available in filter expressions, attrs are matched as `key=value`.
+var EntryFilterFields = filter.Fields[Entry]{
+	"level": func(val Entry) []string { return filter.String(val.Level) },
+	"msg":   func(val Entry) []string { return filter.String(val.Msg) },
+	"attrs": func(val Entry) []string {
+		res := make([]string, 0, len(val.Attrs))
+		for k, v := range val.Attrs {
+			res = append(res, k+"="+v)
+		}
+		return res
+	},
+}
+
 type Entry struct {
 	Cursor stream.Cursor     `json:"cursor,omitempty"`
 	Time   time.Time         `json:"time"`
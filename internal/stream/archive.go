@@ -0,0 +1,397 @@
+package stream
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	archiveSegmentExt        = ".ndjson"
+	archiveQueueSize         = 1024
+	archiveMaxLineLength     = 1 << 20
+	archiveRetentionInterval = time.Minute
+)
+
+type ArchiveConfig struct {
+	Dir         string
+	SegmentSize int64
+	MaxSize     int64
+	MaxAge      time.Duration
+}
+
+// Archive is disk-backed history of stream entries, stored as rotating NDJSON segment files.
+type Archive[T any] struct {
+	cfg      ArchiveConfig
+	name     string
+	logger   *slog.Logger
+	queue    chan streamEntry[T]
+	done     chan struct{}
+	dropped  atomic.Int64
+	mu       sync.Mutex
+	segments []archiveSegment // sorted by the first cursor
+	evicted  Cursor           // the latest entry of removed segments
+	file     *os.File
+	writer   *bufio.Writer
+}
+
+type archiveSegment struct {
+	path    string
+	first   Cursor
+	last    Cursor // unknown (zero) for segments loaded from disk until they are read
+	size    int64
+	modTime time.Time
+}
+
+type archiveLine struct {
+	Cursor Cursor          `json:"c"`
+	Val    json.RawMessage `json:"v"`
+}
+
+func NewArchive[T any](cfg ArchiveConfig, name string, logger *slog.Logger) (*Archive[T], error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create archive dir: %w", err)
+	}
+	s := &Archive[T]{
+		cfg:    cfg,
+		name:   name,
+		logger: logger,
+		queue:  make(chan streamEntry[T], archiveQueueSize),
+		done:   make(chan struct{}),
+	}
+	if err := s.loadSegments(); err != nil {
+		return nil, err
+	}
+	go s.writeLoop()
+	return s, nil
+}
+
+func (s *Archive[T]) loadSegments() error {
+	files, err := filepath.Glob(filepath.Join(s.cfg.Dir, s.name+"-*"+archiveSegmentExt))
+	if err != nil {
+		return fmt.Errorf("failed to list archive segments: %w", err)
+	}
+	for _, file := range files {
+		cursor, err := ParseCursor(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), s.name+"-"), archiveSegmentExt))
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, archiveSegment{file, cursor, 0, info.Size(), info.ModTime()})
+	}
+	slices.SortFunc(s.segments, func(a, b archiveSegment) int {
+		return cmp.Compare(a.first, b.first)
+	})
+	return nil
+}
+
+// add enqueues entry to be written, it never blocks and drops the entry if writer can't keep up.
+// It is called under the stream lock, so it must not log (log stream could be archived itself).
+func (s *Archive[T]) add(entry streamEntry[T]) {
+	select {
+	case s.queue <- entry:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Close flushes pending entries to disk and stops the writer.
+func (s *Archive[T]) Close() {
+	close(s.queue)
+	<-s.done
+}
+
+func (s *Archive[T]) writeLoop() {
+	defer close(s.done)
+	// retention is also enforced periodically, as segments are not rotated when nothing is written
+	ticker := time.NewTicker(archiveRetentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry, ok := <-s.queue:
+			if !ok {
+				s.mu.Lock()
+				s.closeSegment()
+				s.mu.Unlock()
+				return
+			}
+			if dropped := s.dropped.Swap(0); dropped > 0 {
+				s.logger.Warn("archive queue overflow, entries dropped", "archive", s.name, "count", dropped)
+			}
+			if err := s.write(entry); err != nil {
+				s.logger.Error("failed to write archive entry", "archive", s.name, "err", err)
+			}
+			if len(s.queue) == 0 {
+				s.flush()
+			}
+		case <-ticker.C:
+			s.mu.Lock()
+			s.removeOutdated()
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Archive[T]) write(entry streamEntry[T]) error {
+	val, err := json.Marshal(entry.Val)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(archiveLine{entry.Cursor, val})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil || s.segments[len(s.segments)-1].size+int64(len(line)) > s.cfg.SegmentSize {
+		if err := s.rotate(entry.Cursor); err != nil {
+			return err
+		}
+	}
+	if _, err := s.writer.Write(line); err != nil {
+		return err
+	}
+	seg := &s.segments[len(s.segments)-1]
+	seg.last = entry.Cursor
+	seg.size += int64(len(line))
+	seg.modTime = time.Now()
+	return nil
+}
+
+func (s *Archive[T]) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writer != nil {
+		if err := s.writer.Flush(); err != nil {
+			s.logger.Error("failed to flush archive segment", "archive", s.name, "err", err)
+		}
+	}
+}
+
+func (s *Archive[T]) rotate(first Cursor) error {
+	s.closeSegment()
+	path := filepath.Join(s.cfg.Dir, fmt.Sprintf("%s-%s%s", s.name, first, archiveSegmentExt))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create archive segment: %w", err)
+	}
+	s.file = f
+	s.writer = bufio.NewWriter(f)
+	s.segments = append(s.segments, archiveSegment{path, first, first, 0, time.Now()})
+	s.removeOutdated()
+	return nil
+}
+
+func (s *Archive[T]) closeSegment() {
+	if s.file == nil {
+		return
+	}
+	_ = s.writer.Flush()
+	_ = s.file.Close()
+	s.file, s.writer = nil, nil
+}
+
+// removeOutdated deletes the oldest segments exceeding size or age limits, the last segment is
+// kept when the size is exceeded, but it's closed and deleted as well when it's outdated.
+func (s *Archive[T]) removeOutdated() {
+	var totalSize int64
+	for _, seg := range s.segments {
+		totalSize += seg.size
+	}
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		outdated := s.cfg.MaxAge > 0 && time.Since(seg.modTime) > s.cfg.MaxAge
+		if !outdated && (s.cfg.MaxSize <= 0 || totalSize <= s.cfg.MaxSize || len(s.segments) == 1) {
+			break
+		}
+		if len(s.segments) == 1 {
+			s.closeSegment()
+		}
+		s.evicted = max(s.evicted, s.segmentLast(seg))
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			s.logger.Error("failed to remove archive segment", "archive", s.name, "err", err, "file", seg.path)
+		}
+		totalSize -= seg.size
+		s.segments = s.segments[1:]
+	}
+}
+
+// segmentLast returns cursor of the last entry of the segment, it's read from the file for segments loaded from disk.
+// If the file can't be read, the segment is assumed to end right before the next one.
+func (s *Archive[T]) segmentLast(seg archiveSegment) Cursor {
+	if seg.last != 0 {
+		return seg.last
+	}
+	last, err := readArchiveSegmentLast(seg.path)
+	if err == nil && last != 0 {
+		return last
+	}
+	if err != nil {
+		s.logger.Error("failed to read archive segment", "archive", s.name, "err", err, "file", seg.path)
+	}
+	if len(s.segments) > 1 {
+		return s.segments[1].first - 1
+	}
+	return seg.first
+}
+
+// Evicted returns cursor of the latest entry removed from the archive by retention.
+func (s *Archive[T]) Evicted() (Cursor, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.evicted, s.evicted != 0
+}
+
+// Oldest returns cursor of the oldest archived entry.
+func (s *Archive[T]) Oldest() (Cursor, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segments) == 0 {
+		return 0, false
+	}
+	return s.segments[0].first, true
+}
+
+// query returns entries after the cursor and before the bound (or before the cursor and after the bound for backward query).
+func (s *Archive[T]) query(forward bool, cursor, bound Cursor, count int, predicate func(val T) bool) QueryResult[T] {
+	s.flush()
+
+	s.mu.Lock()
+	segments := slices.Clone(s.segments)
+	s.mu.Unlock()
+
+	res := QueryResult[T]{FirstCursor: cursor, LastCursor: cursor}
+
+	// index of the segment which may contain entries next to the cursor
+	pos := sort.Search(len(segments), func(i int) bool { return segments[i].first > cursor }) - 1
+	step := -1
+	if forward {
+		pos, step = max(pos, 0), 1
+	}
+	for ; pos >= 0 && pos < len(segments); pos += step {
+		after, before := cursor, bound
+		if !forward {
+			after, before = bound, cursor
+		}
+		lines, err := readArchiveSegment(segments[pos].path, after, before)
+		if err != nil {
+			s.logger.Error("failed to read archive segment", "archive", s.name, "err", err, "file", segments[pos].path)
+			continue
+		}
+		if !forward {
+			slices.Reverse(lines)
+		}
+		if done := res.collect(lines, count, predicate); done {
+			break
+		}
+		// entries of a segment precede the first entry of the next one, so the rest of segments are out of range
+		if forward && pos+1 < len(segments) && segments[pos+1].first >= bound {
+			break
+		}
+		if !forward && segments[pos].first <= bound {
+			break
+		}
+	}
+	return res
+}
+
+func (s *QueryResult[T]) collect(lines []archiveLine, count int, predicate func(val T) bool) (done bool) {
+	for _, line := range lines {
+		var val T
+		if err := json.Unmarshal(line.Val, &val); err != nil {
+			continue
+		}
+		if predicate != nil && !predicate(val) {
+			continue
+		}
+		if len(s.Items) >= count {
+			s.HasMore = true
+			return true
+		}
+		s.Items = append(s.Items, val)
+		if len(s.Items) == 1 {
+			s.FirstCursor = line.Cursor
+		}
+		s.LastCursor = line.Cursor
+	}
+	return false
+}
+
+// readArchiveSegment returns lines of the segment with cursors after and before the given ones,
+// only these lines are fully parsed.
+func readArchiveSegment(path string, after, before Cursor) ([]archiveLine, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil // segment was removed by retention
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []archiveLine
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), archiveMaxLineLength)
+	for scanner.Scan() {
+		if c, ok := archiveLineCursor(scanner.Bytes()); ok {
+			if c >= before {
+				break // lines are ordered by cursor
+			}
+			if c <= after {
+				continue
+			}
+		}
+		var line archiveLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue // the last line could be partially written
+		}
+		if line.Cursor > after && line.Cursor < before {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// readArchiveSegmentLast returns cursor of the last line of the segment.
+func readArchiveSegmentLast(path string) (Cursor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var last Cursor
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), archiveMaxLineLength)
+	for scanner.Scan() {
+		if c, ok := archiveLineCursor(scanner.Bytes()); ok {
+			last = c
+		}
+	}
+	return last, scanner.Err()
+}
+
+// archiveLineCursor extracts cursor from the beginning of the line written by Archive without parsing the whole line.
+func archiveLineCursor(b []byte) (Cursor, bool) {
+	const prefix = `{"c":"`
+	const end = len(prefix) + 16
+	if len(b) <= end || string(b[:len(prefix)]) != prefix || b[end] != '"' {
+		return 0, false
+	}
+	c, err := ParseCursor(string(b[len(prefix):end]))
+	return c, err == nil
+}
@@ -0,0 +1,273 @@
+package stream
+
+import (
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+type testArchiveEntry struct {
+	Cursor Cursor `json:"cursor"`
+	N      int    `json:"n"`
+}
+
+func (e *testArchiveEntry) SetCursor(cursor Cursor) {
+	e.Cursor = cursor
+}
+
+// newTestArchive returns closed archive of count entries appended at the given time, about 3 entries fit a segment.
+func newTestArchive(t *testing.T, cfg ArchiveConfig, at time.Time, count int) *Archive[testArchiveEntry] {
+	t.Helper()
+	if cfg.Dir == "" {
+		cfg.Dir = t.TempDir()
+	}
+	cfg.SegmentSize = 200
+	archive, err := NewArchive[testArchiveEntry](cfg, "test", testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range count {
+		cursor := testCursor(at, i)
+		archive.add(streamEntry[testArchiveEntry]{cursor, testArchiveEntry{cursor, i}})
+	}
+	archive.Close()
+	return archive
+}
+
+// testCursor returns cursor of the n-th test entry, cursors are not consecutive to tell entries from gaps between them.
+func testCursor(at time.Time, n int) Cursor {
+	return newCursor(at, int32(n*2))
+}
+
+func entryNumbers(entries []testArchiveEntry) []int {
+	res := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		res = append(res, entry.N)
+	}
+	return res
+}
+
+func TestArchiveQuery(t *testing.T) {
+	at := time.Now()
+	archive := newTestArchive(t, ArchiveConfig{}, at, 20)
+	if len(archive.segments) < 5 {
+		t.Fatalf("got %d segments, want entries spread over several ones", len(archive.segments))
+	}
+	even := func(e testArchiveEntry) bool { return e.N%2 == 0 }
+
+	tests := []struct {
+		name      string
+		forward   bool
+		cursor    Cursor
+		bound     Cursor
+		count     int
+		predicate func(e testArchiveEntry) bool
+		want      []int
+		hasMore   bool
+	}{
+		{name: "forward", forward: true, cursor: 0, bound: math.MaxUint64, count: 5, want: []int{0, 1, 2, 3, 4}, hasMore: true},
+		{name: "forward from cursor", forward: true, cursor: testCursor(at, 7), bound: math.MaxUint64, count: 3, want: []int{8, 9, 10}, hasMore: true},
+		{name: "forward till the end", forward: true, cursor: testCursor(at, 16), bound: math.MaxUint64, count: 5, want: []int{17, 18, 19}},
+		{name: "forward with bound", forward: true, cursor: testCursor(at, 2), bound: testCursor(at, 6), count: 10, want: []int{3, 4, 5}},
+		{name: "forward with predicate", forward: true, cursor: testCursor(at, 4), bound: math.MaxUint64, count: 3, predicate: even, want: []int{6, 8, 10}, hasMore: true},
+		{name: "backward", cursor: math.MaxUint64, bound: 0, count: 4, want: []int{19, 18, 17, 16}, hasMore: true},
+		{name: "backward from cursor", cursor: testCursor(at, 9), bound: 0, count: 3, want: []int{8, 7, 6}, hasMore: true},
+		{name: "backward till the start", cursor: testCursor(at, 2), bound: 0, count: 5, want: []int{1, 0}},
+		{name: "backward with bound", cursor: testCursor(at, 12), bound: testCursor(at, 8), count: 10, want: []int{11, 10, 9}},
+		{name: "backward with predicate", cursor: testCursor(at, 13), bound: 0, count: 2, predicate: even, want: []int{12, 10}, hasMore: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := archive.query(tt.forward, tt.cursor, tt.bound, tt.count, tt.predicate)
+			if got := entryNumbers(res.Items); !slices.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			if res.HasMore != tt.hasMore {
+				t.Errorf("got has more %v, want %v", res.HasMore, tt.hasMore)
+			}
+			if res.FirstCursor != res.Items[0].Cursor || res.LastCursor != res.Items[len(res.Items)-1].Cursor {
+				t.Errorf("got cursors %s-%s, want %s-%s", res.FirstCursor, res.LastCursor, res.Items[0].Cursor, res.Items[len(res.Items)-1].Cursor)
+			}
+		})
+	}
+}
+
+func TestArchiveReopen(t *testing.T) {
+	at := time.Now()
+	dir := t.TempDir()
+	newTestArchive(t, ArchiveConfig{Dir: dir}, at, 10)
+
+	// the partially written last line is skipped, the next entries are appended to a new segment
+	segments, err := filepath.Glob(filepath.Join(dir, "test-*"+archiveSegmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(segments)
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString(`{"c":"` + testCursor(at, 10).String() + `","v":{"cur`)
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := NewArchive[testArchiveEntry](ArchiveConfig{Dir: dir, SegmentSize: 200}, "test", testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 11; i < 13; i++ {
+		cursor := testCursor(at.Add(time.Millisecond), i)
+		archive.add(streamEntry[testArchiveEntry]{cursor, testArchiveEntry{cursor, i}})
+	}
+	archive.Close()
+
+	if oldest, ok := archive.Oldest(); !ok || oldest != testCursor(at, 0) {
+		t.Errorf("got oldest %s, want %s", oldest, testCursor(at, 0))
+	}
+	res := archive.query(true, 0, math.MaxUint64, 100, nil)
+	if got, want := entryNumbers(res.Items), []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 11, 12}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestArchiveRetention(t *testing.T) {
+	at := time.Now()
+
+	t.Run("max size", func(t *testing.T) {
+		archive := newTestArchive(t, ArchiveConfig{MaxSize: 500}, at, 20)
+		res := archive.query(true, 0, math.MaxUint64, 100, nil)
+		if len(res.Items) == 0 || res.Items[len(res.Items)-1].N != 19 || res.Items[0].N == 0 {
+			t.Fatalf("got %v, want the oldest entries to be removed", entryNumbers(res.Items))
+		}
+		// limit is enforced on rotation, so the current segment can grow over it
+		var size int64
+		for _, seg := range archive.segments {
+			size += seg.size
+		}
+		if size > 500+200 {
+			t.Errorf("got archive size %d, want at most 700", size)
+		}
+		if oldest, _ := archive.Oldest(); oldest != res.Items[0].Cursor {
+			t.Errorf("got oldest %s, want %s", oldest, res.Items[0].Cursor)
+		}
+		// the entry right before the oldest remaining one is the latest evicted
+		if evicted, ok := archive.Evicted(); !ok || evicted != testCursor(at, res.Items[0].N-1) {
+			t.Errorf("got evicted %s, want %s", evicted, testCursor(at, res.Items[0].N-1))
+		}
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		dir := t.TempDir()
+		written := newTestArchive(t, ArchiveConfig{Dir: dir}, at, 20)
+		old := written.segments[:2]
+		for _, seg := range old {
+			if err := os.Chtimes(seg.path, time.Time{}, time.Now().Add(-2*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wantOldest, wantEvicted := written.segments[2].first, written.segments[1].last
+
+		// segments loaded from disk have unknown last cursors, so they are read on removal
+		archive, err := NewArchive[testArchiveEntry](ArchiveConfig{Dir: dir, SegmentSize: 200, MaxAge: time.Hour}, "test", testLogger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer archive.Close()
+		if _, ok := archive.Evicted(); ok {
+			t.Error("nothing is evicted before retention is applied")
+		}
+
+		archive.mu.Lock()
+		archive.removeOutdated()
+		archive.mu.Unlock()
+		if oldest, _ := archive.Oldest(); oldest != wantOldest {
+			t.Errorf("got oldest %s, want %s", oldest, wantOldest)
+		}
+		if evicted, ok := archive.Evicted(); !ok || evicted != wantEvicted {
+			t.Errorf("got evicted %s, want %s", evicted, wantEvicted)
+		}
+		for _, seg := range old {
+			if _, err := os.Stat(seg.path); !os.IsNotExist(err) {
+				t.Errorf("outdated segment %s wasn't removed: %v", seg.path, err)
+			}
+		}
+	})
+}
+
+func TestBufferedArchive(t *testing.T) {
+	archive, err := NewArchive[testArchiveEntry](ArchiveConfig{Dir: t.TempDir(), SegmentSize: 200}, "test", testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := NewBufferedStream[testArchiveEntry](5)
+	st.SetArchive(archive)
+	for i := range 20 {
+		st.Append(testArchiveEntry{N: i})
+	}
+	archive.Close()
+
+	// pages continue from the archive into the buffer and back
+	var forward []int
+	for res := st.Query(0, 3, nil); ; res = st.Query(res.LastCursor, 3, nil) {
+		forward = append(forward, entryNumbers(res.Items)...)
+		if !res.HasMore {
+			break
+		}
+	}
+	var backward []int
+	for res := st.QueryBackward(math.MaxUint64, 3, nil); ; res = st.QueryBackward(res.LastCursor, 3, nil) {
+		backward = append(backward, entryNumbers(res.Items)...)
+		if !res.HasMore {
+			break
+		}
+	}
+	want := make([]int, 20)
+	for i := range want {
+		want[i] = i
+	}
+	if !slices.Equal(forward, want) {
+		t.Errorf("got forward %v, want %v", forward, want)
+	}
+	slices.Reverse(want)
+	if !slices.Equal(backward, want) {
+		t.Errorf("got backward %v, want %v", backward, want)
+	}
+
+	// entries evicted from the buffer are still in the archive
+	if _, ok := st.Evicted(); ok {
+		t.Error("got evicted entries, want none")
+	}
+	first := st.Query(0, 1, nil)
+	if oldest, ok := st.Oldest(); !ok || oldest != first.FirstCursor || first.Items[0].N != 0 {
+		t.Errorf("got oldest %s, want %s", oldest, first.FirstCursor)
+	}
+}
+
+func TestBufferedEvicted(t *testing.T) {
+	st := NewBufferedStream[testArchiveEntry](3)
+	created, ok := st.Evicted()
+	if !ok {
+		t.Fatal("entries appended before the stream was created must be reported as evicted")
+	}
+	for i := range 5 {
+		st.Append(testArchiveEntry{N: i})
+	}
+	all := st.Query(created, 10, nil)
+	if got := entryNumbers(all.Items); !slices.Equal(got, []int{2, 3, 4}) {
+		t.Fatalf("got %v, want [2 3 4]", got)
+	}
+	// entries 0 and 1 are evicted, so only a client which has seen entry 1 resumes without a gap
+	evicted, _ := st.Evicted()
+	if evicted <= created || evicted >= all.FirstCursor {
+		t.Errorf("got evicted %s, want between %s and %s", evicted, created, all.FirstCursor)
+	}
+}
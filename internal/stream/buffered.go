@@ -3,6 +3,8 @@ package stream
 import (
 	"cmp"
 	"iter"
+	"maps"
+	"math"
 	"slices"
 	"sort"
 	"sync"
@@ -17,8 +19,11 @@ type Buffered[T any] struct {
 	mu           sync.RWMutex
 	buf          *util.RingBuf[streamEntry[T]]
 	index        int32
-	listeners    map[uint16]func(cursor Cursor, val T)
+	listeners    map[uint16]*subscriber[T]
 	nextListener uint16
+	dropped      map[string]uint64 // notifications dropped by stopped listeners
+	evicted      Cursor            // the latest entry evicted from the buffer, entries preceding the stream creation are evicted too
+	archive      *Archive[T]
 }
 
 type QueryResult[T any] struct {
@@ -33,6 +38,19 @@ func (s *QueryResult[T]) Reverse() {
 	s.FirstCursor, s.LastCursor = s.LastCursor, s.FirstCursor
 }
 
+// concat appends the result of the query continuing this one.
+func (s *QueryResult[T]) concat(next QueryResult[T]) {
+	s.HasMore = next.HasMore
+	if len(next.Items) == 0 {
+		return
+	}
+	if len(s.Items) == 0 {
+		s.FirstCursor = next.FirstCursor
+	}
+	s.Items = append(s.Items, next.Items...)
+	s.LastCursor = next.LastCursor
+}
+
 type streamEntry[T any] struct {
 	Cursor Cursor
 	Val    T
@@ -41,36 +59,167 @@ type streamEntry[T any] struct {
 func NewBufferedStream[T any](bufferSize int) *Buffered[T] {
 	return &Buffered[T]{
 		buf:       util.NewRingBuf[streamEntry[T]](bufferSize),
-		listeners: map[uint16]func(cursor Cursor, val T){},
+		listeners: map[uint16]*subscriber[T]{},
+		dropped:   map[string]uint64{},
+		evicted:   CursorAt(time.Now()),
 	}
 }
 
 func (s *Buffered[T]) Append(value T) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	cursor := Cursor((uint64(time.Now().UnixMilli()) << 32) | uint64(s.index))
+	cursor := newCursor(time.Now(), s.index)
 	s.index++
 	if c, ok := any(value).(CursorAware); ok {
 		c.SetCursor(cursor)
 	} else if c, ok := any(&value).(CursorAware); ok {
 		c.SetCursor(cursor)
 	}
-	s.buf.Add(streamEntry[T]{cursor, value})
+	entry := streamEntry[T]{cursor, value}
+	if s.buf.Size() == s.buf.Cap() {
+		s.evicted = s.buf.Get(0).Cursor
+	}
+	s.buf.Add(entry)
+	if s.archive != nil {
+		s.archive.add(entry)
+	}
 	for _, listener := range s.listeners {
-		listener(cursor, value)
+		listener.notify()
 	}
 }
 
-func (s *Buffered[T]) Query(cursor Cursor, count int, predicate func(val T) bool) QueryResult[T] {
+// Dropped returns number of notifications dropped because listeners couldn't keep up, by listener name.
+func (s *Buffered[T]) Dropped() map[string]uint64 {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.query(true, cursor, count, predicate)
+	res := maps.Clone(s.dropped)
+	for _, listener := range s.listeners {
+		res[listener.name] += listener.dropped.Load()
+	}
+	return res
 }
 
-func (s *Buffered[T]) QueryBackward(cursor Cursor, count int, predicate func(val T) bool) QueryResult[T] {
+// pending returns up to count entries appended since the last call for the subscriber,
+// entries evicted from the buffer meanwhile are counted as dropped.
+func (s *Buffered[T]) pending(sub *subscriber[T], count int) []streamEntry[T] {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.query(false, cursor, count, predicate)
+	oldest := s.index - int32(s.buf.Size())
+	if lost := oldest - sub.next; lost > 0 {
+		sub.dropped.Add(uint64(lost))
+		sub.next = oldest
+	}
+	entries := s.buf.Slice(int(sub.next-oldest), count)
+	sub.next += int32(len(entries))
+	return entries
+}
+
+// SetArchive attaches disk-backed history, appended entries are written to it
+// and queries continue into it once the in-memory buffer is exhausted.
+func (s *Buffered[T]) SetArchive(archive *Archive[T]) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.archive = archive
+}
+
+func (s *Buffered[T]) Query(cursor Cursor, count int, predicate func(val T) bool) QueryResult[T] {
+	return s.QueryRange(cursor, math.MaxUint64, false, count, predicate)
+}
+
+func (s *Buffered[T]) QueryBackward(cursor Cursor, count int, predicate func(val T) bool) QueryResult[T] {
+	return s.QueryRange(0, cursor, true, count, predicate)
+}
+
+// QueryRange returns entries with cursors strictly between after and before,
+// starting next to after, or next to before for backward query.
+func (s *Buffered[T]) QueryRange(after, before Cursor, backward bool, count int, predicate func(val T) bool) QueryResult[T] {
+	if backward {
+		return s.queryRangeBackward(after, before, count, predicate)
+	}
+	return s.queryRangeForward(after, before, count, predicate)
+}
+
+func (s *Buffered[T]) queryRangeForward(after, before Cursor, count int, predicate func(val T) bool) QueryResult[T] {
+	s.mu.RLock()
+	archive := s.archive
+	oldest, hasOldest := s.oldest()
+	s.mu.RUnlock()
+
+	if archive == nil || (hasOldest && after >= oldest) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.query(true, after, before, count, predicate)
+	}
+
+	// cursor is older than the buffer, so start from the archived entries preceding it
+	bound := before
+	if hasOldest {
+		bound = min(before, oldest)
+	}
+	res := archive.query(true, after, bound, count, predicate)
+	if res.HasMore || bound == before {
+		return res
+	}
+	s.mu.RLock()
+	res.concat(s.query(true, res.LastCursor, before, count-len(res.Items), predicate))
+	s.mu.RUnlock()
+	return res
+}
+
+func (s *Buffered[T]) queryRangeBackward(after, before Cursor, count int, predicate func(val T) bool) QueryResult[T] {
+	s.mu.RLock()
+	archive := s.archive
+	oldest, hasOldest := s.oldest()
+	res := s.query(false, before, after, count, predicate)
+	s.mu.RUnlock()
+
+	if archive == nil || res.HasMore {
+		return res
+	}
+	// buffer is exhausted, continue with the archived entries preceding it
+	from := before
+	if hasOldest {
+		from = min(before, oldest)
+	}
+	if from > after {
+		res.concat(archive.query(false, from, after, count-len(res.Items), predicate))
+	}
+	return res
+}
+
+// Oldest returns cursor of the oldest entry available in the buffer or in the archive.
+func (s *Buffered[T]) Oldest() (Cursor, bool) {
+	s.mu.RLock()
+	archive := s.archive
+	oldest, ok := s.oldest()
+	s.mu.RUnlock()
+	if archive != nil {
+		if archived, archivedOk := archive.Oldest(); archivedOk && (!ok || archived < oldest) {
+			return archived, true
+		}
+	}
+	return oldest, ok
+}
+
+// Evicted returns cursor of the latest entry which is no longer available, entries after it are either
+// in the buffer or in the archive. Without archive entries appended before the stream was created are lost,
+// so such cursors are reported as evicted.
+func (s *Buffered[T]) Evicted() (Cursor, bool) {
+	s.mu.RLock()
+	archive := s.archive
+	evicted := s.evicted
+	s.mu.RUnlock()
+	if archive != nil {
+		return archive.Evicted()
+	}
+	return evicted, true
+}
+
+func (s *Buffered[T]) oldest() (Cursor, bool) {
+	if s.buf.Size() == 0 {
+		return 0, false
+	}
+	return s.buf.Get(0).Cursor, true
 }
 
 func (s *Buffered[T]) lookupPos(cursor Cursor) (i int, found bool) {
@@ -80,7 +229,7 @@ func (s *Buffered[T]) lookupPos(cursor Cursor) (i int, found bool) {
 }
 
 //nolint:cyclop // readable enough
-func (s *Buffered[T]) query(forward bool, cursor Cursor, count int, predicate func(val T) bool) QueryResult[T] {
+func (s *Buffered[T]) query(forward bool, cursor, bound Cursor, count int, predicate func(val T) bool) QueryResult[T] {
 	backward := !forward
 
 	pos, found := s.lookupPos(cursor)
@@ -107,6 +256,9 @@ func (s *Buffered[T]) query(forward bool, cursor Cursor, count int, predicate fu
 	}
 
 	for it := range iterator {
+		if (forward && it.Cursor >= bound) || (backward && it.Cursor <= bound) {
+			break
+		}
 		if predicate != nil && !predicate(it.Val) {
 			continue
 		}
@@ -126,16 +278,25 @@ func (s *Buffered[T]) query(forward bool, cursor Cursor, count int, predicate fu
 	return res
 }
 
-func (s *Buffered[T]) Listen(listener func(cursor Cursor, val T)) (stop func()) {
+// Listen registers listener notified about appended entries asynchronously, notifications are dropped
+// when the listener falls behind by more than the buffer size. Dropped notifications are accounted by the name.
+func (s *Buffered[T]) Listen(name string, listener func(cursor Cursor, val T)) (stop func()) {
+	sub := newSubscriber(s, name, listener)
+
 	s.mu.Lock()
 	listenerKey := s.nextListener
 	s.nextListener++
-	s.listeners[listenerKey] = listener
+	s.listeners[listenerKey] = sub
+	sub.next = s.index
 	s.mu.Unlock()
 
+	go sub.run()
+
 	return func() {
+		sub.stop()
 		s.mu.Lock()
 		delete(s.listeners, listenerKey)
+		s.dropped[name] += sub.dropped.Load()
 		s.mu.Unlock()
 	}
 }
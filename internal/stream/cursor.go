@@ -3,6 +3,7 @@ package stream
 import (
 	"fmt"
 	"strconv"
+	"time"
 )
 
 type Cursor uint64
@@ -11,6 +12,15 @@ type CursorAware interface {
 	SetCursor(cursor Cursor)
 }
 
+func newCursor(t time.Time, index int32) Cursor {
+	return Cursor((uint64(t.UnixMilli()) << 32) | uint64(index))
+}
+
+// CursorAt returns the lowest cursor of entries appended at t, entries appended later have greater cursors.
+func CursorAt(t time.Time) Cursor {
+	return newCursor(t, 0)
+}
+
 func (c Cursor) String() string {
 	return fmt.Sprintf("%016x", uint64(c))
 }
@@ -2,5 +2,5 @@ package stream
 
 type Stream[T any] interface {
 	Append(value T)
-	Listen(listener func(cursor Cursor, val T)) (stop func())
+	Listen(name string, listener func(cursor Cursor, val T)) (stop func())
 }
@@ -0,0 +1,66 @@
+package stream
+
+import "sync/atomic"
+
+// subscriberBatchSize is the max number of entries a subscriber reads from the stream at once.
+const subscriberBatchSize = 256
+
+// subscriber delivers appended entries to the listener from its own goroutine, so that a slow listener never blocks
+// appending to the stream. Append only signals the subscriber, it then reads the entries from the stream buffer,
+// so the buffer is the bound of the subscriber backlog: entries evicted before being read are counted as dropped.
+type subscriber[T any] struct {
+	stream   *Buffered[T]
+	name     string
+	listener func(cursor Cursor, val T)
+	next     int32 // index of the next entry to deliver, accessed by the subscriber goroutine under the stream lock
+	signal   chan struct{}
+	done     chan struct{}
+	dropped  atomic.Uint64
+}
+
+func newSubscriber[T any](stream *Buffered[T], name string, listener func(cursor Cursor, val T)) *subscriber[T] {
+	return &subscriber[T]{
+		stream:   stream,
+		name:     name,
+		listener: listener,
+		signal:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// notify wakes up the subscriber without blocking, pending signal already covers the new entry.
+func (s *subscriber[T]) notify() {
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// stop stops delivery, pending notifications are discarded.
+func (s *subscriber[T]) stop() {
+	close(s.done)
+}
+
+func (s *subscriber[T]) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.signal:
+		}
+		for {
+			entries := s.stream.pending(s, subscriberBatchSize)
+			for _, entry := range entries {
+				select {
+				case <-s.done:
+					return
+				default:
+					s.listener(entry.Cursor, entry.Val)
+				}
+			}
+			if len(entries) < subscriberBatchSize {
+				break
+			}
+		}
+	}
+}
@@ -35,12 +35,16 @@ func (s *RingBuf[T]) Size() int {
 	return s.size
 }
 
+func (s *RingBuf[T]) Cap() int {
+	return cap(s.buf)
+}
+
 func (s *RingBuf[T]) Slice(from, count int) []T {
 	if s.size == 0 || from < 0 || count <= 0 || from >= s.size {
 		return nil
 	}
 	capacity := cap(s.buf)
-	count = min(count, s.size)
+	count = min(count, s.size-from)
 	res := make([]T, count)
 	from += s.start
 	for i := 0; i < count; i++ {